@@ -0,0 +1,253 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Response cache shared by all protocols. Answers live in memory only.
+const (
+	responseCacheTTL  = 0 * time.Second // How long an answer is reused (0 disables the cache)
+	responseCacheSize = 1000            // Maximum number of cached answers
+)
+
+var llmCache = &responseCache{
+	ttl:     responseCacheTTL,
+	entries: newMemoryStore(responseCacheSize),
+	flights: make(map[string]*flight),
+}
+
+// flight is an upstream call that identical concurrent requests wait on
+type flight struct {
+	done  chan struct{}
+	value string
+	err   error
+}
+
+type responseCache struct {
+	ttl     time.Duration // How long an answer is reused (0 disables the cache)
+	entries Store
+	mu      sync.Mutex // Guards flights
+	flights map[string]*flight
+}
+
+type noCacheKey struct{}
+
+type cacheHitKey struct{}
+
+// cacheHit is where cachedLLM notes when an answer it served from the cache
+// expires, for protocols whose clients cache answers in turn (DNS)
+type cacheHit struct {
+	mu      sync.Mutex
+	expires time.Time
+}
+
+// withCacheHit lets the caller learn whether calls made with ctx were
+// answered from the cache, and until when
+func withCacheHit(ctx context.Context) (context.Context, *cacheHit) {
+	hit := &cacheHit{}
+	return context.WithValue(ctx, cacheHitKey{}, hit), hit
+}
+
+// recordCacheHit notes the expiry of a cached answer, if the caller asked
+func recordCacheHit(ctx context.Context, expires time.Time) {
+	if hit, ok := ctx.Value(cacheHitKey{}).(*cacheHit); ok {
+		hit.mu.Lock()
+		hit.expires = expires
+		hit.mu.Unlock()
+	}
+}
+
+// Expires returns when the cached answer expires, or the zero time if the
+// answer didn't come from the cache
+func (hit *cacheHit) Expires() time.Time {
+	hit.mu.Lock()
+	defer hit.mu.Unlock()
+	return hit.expires
+}
+
+// cachedAnswer is a cache entry
+type cachedAnswer struct {
+	text    string
+	expires time.Time
+}
+
+// withoutCache makes calls with ctx skip the cache, for callers that want
+// independent answers to the same prompt
+func withoutCache(ctx context.Context) context.Context {
+	return context.WithValue(ctx, noCacheKey{}, true)
+}
+
+// cachedLLM answers from the cache when it can and otherwise calls the
+// backend through callLLM, caching complete answers. It has LLM's contract.
+func cachedLLM(ctx context.Context, input interface{}, stream chan<- string) (string, error) {
+	if llmCache.ttl <= 0 || ctx.Value(noCacheKey{}) != nil {
+		return callLLM(ctx, input, stream)
+	}
+	keyParts := []string{requestedModel(ctx)}
+	switch v := input.(type) {
+	case string:
+		keyParts = append(keyParts, "user", v)
+	case []map[string]string:
+		for _, m := range v {
+			keyParts = append(keyParts, m["role"], m["content"])
+		}
+	default:
+		return callLLM(ctx, input, stream)
+	}
+	key := cacheKey(keyParts...)
+
+	if stream == nil {
+		return llmCache.do(ctx, key, func() (string, error) {
+			return callLLM(ctx, input, nil)
+		})
+	}
+	defer close(stream)
+	send := func(text string) {
+		select {
+		case stream <- text:
+		case <-ctx.Done():
+		}
+	}
+	if answer, ok := llmCache.get(key); ok {
+		recordCacheHit(ctx, answer.expires)
+		send(answer.text)
+		return "", ctx.Err()
+	}
+
+	// Identical streams wait for the first one's answer and replay it whole,
+	// rather than each spending an upstream call
+	f, leader := llmCache.join(key)
+	if !leader {
+		value, ok, err := f.wait(ctx)
+		if ok {
+			if err == nil {
+				send(value)
+			}
+			return "", err
+		}
+		value, err = streamLLM(ctx, input, send)
+		if err == nil && ctx.Err() == nil {
+			llmCache.set(key, value)
+		}
+		return "", err
+	}
+	f.value, f.err = streamLLM(ctx, input, send)
+	if f.err == nil && ctx.Err() != nil {
+		f.err = ctx.Err()
+	}
+	llmCache.land(key, f)
+	return "", f.err
+}
+
+// streamLLM calls the backend through callLLM, passing each chunk to send,
+// and returns the whole answer
+func streamLLM(ctx context.Context, input interface{}, send func(string)) (string, error) {
+	inner := make(chan string)
+	errc := make(chan error, 1)
+	go func() {
+		_, err := callLLM(ctx, input, inner)
+		errc <- err
+	}()
+	var answer strings.Builder
+	for chunk := range inner {
+		answer.WriteString(chunk)
+		send(chunk)
+	}
+	return answer.String(), <-errc
+}
+
+// cacheKey hashes the parts after collapsing whitespace, so trivially
+// different spellings of the same prompt share an entry.
+func cacheKey(parts ...string) string {
+	h := sha256.New()
+	for _, part := range parts {
+		h.Write([]byte(strings.Join(strings.Fields(part), " ")))
+		h.Write([]byte{0})
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+func (c *responseCache) get(key string) (cachedAnswer, bool) {
+	if c.ttl <= 0 {
+		return cachedAnswer{}, false
+	}
+	value, ok := c.entries.Get(key)
+	if !ok {
+		return cachedAnswer{}, false
+	}
+	return value.(cachedAnswer), true
+}
+
+func (c *responseCache) set(key, value string) {
+	if c.ttl <= 0 {
+		return
+	}
+	c.entries.Set(key, cachedAnswer{text: value, expires: time.Now().Add(c.ttl)}, c.ttl)
+}
+
+// do returns the cached answer for key, or runs fn once on behalf of every
+// concurrent caller with the same key and caches its result.
+func (c *responseCache) do(ctx context.Context, key string, fn func() (string, error)) (string, error) {
+	if c.ttl <= 0 {
+		return fn()
+	}
+	if answer, ok := c.get(key); ok {
+		recordCacheHit(ctx, answer.expires)
+		return answer.text, nil
+	}
+
+	f, leader := c.join(key)
+	if !leader {
+		if value, ok, err := f.wait(ctx); ok {
+			return value, err
+		}
+		return fn()
+	}
+	f.value, f.err = fn()
+	c.land(key, f)
+	return f.value, f.err
+}
+
+// join returns the flight for key, starting one if there is none. The caller
+// that started it leads it, and must call land once it has the answer.
+func (c *responseCache) join(key string) (f *flight, leader bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if f, ok := c.flights[key]; ok {
+		return f, false
+	}
+	f = &flight{done: make(chan struct{})}
+	c.flights[key] = f
+	return f, true
+}
+
+// land caches the leading caller's answer and releases everyone waiting on f
+func (c *responseCache) land(key string, f *flight) {
+	if f.err == nil {
+		c.set(key, f.value)
+	}
+	c.mu.Lock()
+	delete(c.flights, key)
+	c.mu.Unlock()
+	close(f.done)
+}
+
+// wait returns the leading caller's answer once it has one. ok is false if
+// the leading caller went away first; the caller should make its own call.
+func (f *flight) wait(ctx context.Context) (value string, ok bool, err error) {
+	select {
+	case <-f.done:
+	case <-ctx.Done():
+		return "", true, ctx.Err()
+	}
+	if errors.Is(f.err, context.Canceled) || errors.Is(f.err, context.DeadlineExceeded) {
+		return "", false, nil
+	}
+	return f.value, true, f.err
+}
@@ -0,0 +1,223 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// useCache gives the rest of the test a fresh response cache keeping
+// answers for ttl
+func useCache(t *testing.T, ttl time.Duration) {
+	t.Helper()
+	old := llmCache
+	llmCache = &responseCache{
+		ttl:     ttl,
+		entries: newMemoryStore(responseCacheSize),
+		flights: make(map[string]*flight),
+	}
+	t.Cleanup(func() { llmCache = old })
+}
+
+// countCalls wraps fn to count how often the backend is called
+func countCalls(fn llmFunc) (llmFunc, *atomic.Int32) {
+	var calls atomic.Int32
+	return func(ctx context.Context, input interface{}, stream chan<- string) (string, error) {
+		calls.Add(1)
+		return fn(ctx, input, stream)
+	}, &calls
+}
+
+func TestCacheKeyNormalizesWhitespace(t *testing.T) {
+	if cacheKey("", "user", "what  is\tdns?\n") != cacheKey("", "user", "what is dns?") {
+		t.Error("whitespace variants got different keys")
+	}
+	if cacheKey("", "user", "ab") == cacheKey("", "us", "erab") {
+		t.Error("parts run together: different splits got the same key")
+	}
+}
+
+func TestCachedLLMHits(t *testing.T) {
+	useCache(t, time.Minute)
+	backend, calls := countCalls(replyWith("4"))
+	stubLLM(t, backend)
+
+	for _, prompt := range []string{"what is 2+2?", "what  is 2+2?"} {
+		if got, err := cachedLLM(context.Background(), prompt, nil); err != nil || got != "4" {
+			t.Fatalf("cachedLLM(%q) = %q, %v", prompt, got, err)
+		}
+	}
+	if n := calls.Load(); n != 1 {
+		t.Errorf("backend called %d times for one question, want 1", n)
+	}
+
+	cachedLLM(withModel(context.Background(), "other"), "what is 2+2?", nil)
+	cachedLLM(context.Background(), "what is 3+3?", nil)
+	cachedLLM(withoutCache(context.Background()), "what is 2+2?", nil)
+	if n := calls.Load(); n != 4 {
+		t.Errorf("backend called %d times, want one more each for another model, another prompt and withoutCache", n)
+	}
+}
+
+func TestCachedLLMRecordsHit(t *testing.T) {
+	useCache(t, time.Minute)
+	stubLLM(t, replyWith("pass"))
+
+	ctx, hit := withCacheHit(context.Background())
+	cachedLLM(ctx, "repeat pass", nil)
+	if !hit.Expires().IsZero() {
+		t.Errorf("fresh answer recorded as a cache hit expiring %s", hit.Expires())
+	}
+	ctx, hit = withCacheHit(context.Background())
+	cachedLLM(ctx, "repeat pass", nil)
+	if left := time.Until(hit.Expires()); left <= 0 || left > time.Minute {
+		t.Errorf("cache hit expires in %s, want within the minute TTL", left)
+	}
+}
+
+func TestCachedLLMExpires(t *testing.T) {
+	useCache(t, 30*time.Millisecond)
+	backend, calls := countCalls(replyWith("pass"))
+	stubLLM(t, backend)
+
+	cachedLLM(context.Background(), "repeat pass", nil)
+	time.Sleep(60 * time.Millisecond)
+	cachedLLM(context.Background(), "repeat pass", nil)
+	if n := calls.Load(); n != 2 {
+		t.Errorf("backend called %d times across the TTL, want 2", n)
+	}
+}
+
+func TestCachedLLMSkipsErrors(t *testing.T) {
+	useCache(t, time.Minute)
+	backend, calls := countCalls(failWith(errors.New("upstream down")))
+	stubLLM(t, backend)
+
+	for i := 0; i < 2; i++ {
+		if _, err := cachedLLM(context.Background(), "hi", nil); err == nil {
+			t.Fatal("error swallowed")
+		}
+	}
+	if n := calls.Load(); n != 2 {
+		t.Errorf("backend called %d times, want a retry after the error", n)
+	}
+}
+
+func TestCachedLLMCoalesces(t *testing.T) {
+	useCache(t, time.Minute)
+	backend, calls := countCalls(slowReply(50*time.Millisecond, "pass"))
+	stubLLM(t, backend)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if got, err := cachedLLM(context.Background(), "repeat pass", nil); err != nil || got != "pass" {
+				t.Errorf("cachedLLM = %q, %v", got, err)
+			}
+		}()
+	}
+	wg.Wait()
+	if n := calls.Load(); n != 1 {
+		t.Errorf("backend called %d times for concurrent identical questions, want 1", n)
+	}
+}
+
+func TestCachedLLMCoalescedCallerOutlivesLeader(t *testing.T) {
+	useCache(t, time.Minute)
+	backend, calls := countCalls(slowReply(50*time.Millisecond, "pass"))
+	started := make(chan struct{}, 2)
+	stubLLM(t, func(ctx context.Context, input interface{}, stream chan<- string) (string, error) {
+		started <- struct{}{}
+		return backend(ctx, input, stream)
+	})
+
+	leader, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	go cachedLLM(leader, "repeat pass", nil)
+	<-started
+
+	// The leader's timeout must not become this caller's answer
+	if got, err := cachedLLM(context.Background(), "repeat pass", nil); err != nil || got != "pass" {
+		t.Errorf("cachedLLM = %q, %v; want its own answer", got, err)
+	}
+	if n := calls.Load(); n != 2 {
+		t.Errorf("backend called %d times, want 2", n)
+	}
+}
+
+func TestCachedLLMStreams(t *testing.T) {
+	useCache(t, time.Minute)
+	backend, calls := countCalls(replyWith("pa", "ss"))
+	stubLLM(t, backend)
+
+	collect := func() string {
+		stream := make(chan string)
+		errc := make(chan error, 1)
+		go func() {
+			_, err := cachedLLM(context.Background(), "repeat pass", stream)
+			errc <- err
+		}()
+		var got string
+		for chunk := range stream {
+			got += chunk
+		}
+		if err := <-errc; err != nil {
+			t.Fatalf("cachedLLM: %v", err)
+		}
+		return got
+	}
+	if first, second := collect(), collect(); first != "pass" || second != "pass" {
+		t.Errorf("streamed %q then %q, want pass both times", first, second)
+	}
+	if n := calls.Load(); n != 1 {
+		t.Errorf("backend called %d times, want the second stream from the cache", n)
+	}
+}
+
+func TestCachedLLMCoalescesStreams(t *testing.T) {
+	useCache(t, time.Minute)
+	backend, calls := countCalls(slowReply(20*time.Millisecond, "pa", "ss"))
+	stubLLM(t, backend)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			stream := make(chan string)
+			errc := make(chan error, 1)
+			go func() {
+				_, err := cachedLLM(context.Background(), "repeat pass", stream)
+				errc <- err
+			}()
+			var got string
+			for chunk := range stream {
+				got += chunk
+			}
+			if err := <-errc; err != nil || got != "pass" {
+				t.Errorf("streamed %q, %v; want pass", got, err)
+			}
+		}()
+	}
+	wg.Wait()
+	if n := calls.Load(); n != 1 {
+		t.Errorf("backend called %d times for concurrent identical streams, want 1", n)
+	}
+}
+
+func TestCacheOff(t *testing.T) {
+	useCache(t, 0)
+	backend, calls := countCalls(replyWith("pass"))
+	stubLLM(t, backend)
+
+	cachedLLM(context.Background(), "repeat pass", nil)
+	cachedLLM(context.Background(), "repeat pass", nil)
+	if n := calls.Load(); n != 2 {
+		t.Errorf("backend called %d times with the cache off, want 2", n)
+	}
+}
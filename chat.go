@@ -9,6 +9,22 @@ const (
 	DNS_PORT   = 53  // DNS TXT chat (set to 0 to disable)
 )
 
+// Interfaces to listen on: "" for all, or an address like "127.0.0.1" to keep a service local
+const (
+	HTTP_BIND  = ""
+	HTTPS_BIND = ""
+	DNS_BIND   = ""
+)
+
+// Build information, shown at /version. Set at build time with
+// -ldflags "-X main.version=1.2.0 -X main.commit=$(git rev-parse HEAD) -X main.buildTime=$(date -u +%FT%TZ)";
+// without it, commit and build time come from what the Go toolchain recorded.
+var (
+	version   = "dev"
+	commit    = ""
+	buildTime = ""
+)
+
 func main() {
 	// SSH Server
 	if SSH_PORT > 0 {
@@ -20,21 +36,23 @@ func main() {
 	// DNS Server
 	if DNS_PORT > 0 {
 		go func() {
-			StartDNSServer(DNS_PORT)
+			StartDNSServer(listenAddr(DNS_BIND, DNS_PORT))
 		}()
 	}
 
 	// HTTP/HTTPS Server
 	// TODO: Implement graceful shutdown with signal handling
 	if HTTP_PORT > 0 || HTTPS_PORT > 0 {
+		mux := newMux()
+
 		if HTTPS_PORT > 0 {
 			go func() {
-				StartHTTPSServer(HTTPS_PORT, "cert.pem", "key.pem")
+				StartHTTPSServer(listenAddr(HTTPS_BIND, HTTPS_PORT), "cert.pem", "key.pem", mux)
 			}()
 		}
 
 		if HTTP_PORT > 0 {
-			StartHTTPServer(HTTP_PORT)
+			StartHTTPServer(listenAddr(HTTP_BIND, HTTP_PORT), mux)
 		} else {
 			// If only HTTPS is enabled, block forever
 			select {}
@@ -2,29 +2,159 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
 	"io"
+	"net"
 	"net/http"
 	"net/url"
 	"os"
-	"os/exec"
+	"strconv"
 	"strings"
 	"time"
 
+	"github.com/miekg/dns"
 	"golang.org/x/crypto/ssh"
+	"golang.org/x/time/rate"
 )
 
+// testResult is one test's outcome, as printed by -json
+type testResult struct {
+	Name       string `json:"name"`
+	Passed     bool   `json:"passed"`
+	Detail     string `json:"detail,omitempty"`
+	DurationMS int64  `json:"duration_ms"`
+}
+
+// check collects the outcome of a single test
+type check struct {
+	passed bool
+	detail string
+}
+
+func (c *check) pass() {
+	c.passed = true
+}
+
+func (c *check) fail(format string, args ...interface{}) {
+	c.passed = false
+	c.detail = fmt.Sprintf(format, args...)
+}
+
+type testCase struct {
+	name string
+	run  func(c *check)
+}
+
+func runTest(tc testCase) testResult {
+	start := time.Now()
+	c := &check{}
+	tc.run(c)
+	return testResult{
+		Name:       tc.name,
+		Passed:     c.passed,
+		Detail:     c.detail,
+		DurationMS: time.Since(start).Milliseconds(),
+	}
+}
+
+// runConcurrently runs tests in parallel, starting them no faster than the
+// limiter allows. Results keep the order of tests; any test still running
+// at the deadline is reported as failed.
+func runConcurrently(tests []testCase, limiter *rate.Limiter, deadline time.Duration) []testResult {
+	ctx, cancel := context.WithTimeout(context.Background(), deadline)
+	defer cancel()
+
+	done := make([]chan testResult, len(tests))
+	for i, tc := range tests {
+		done[i] = make(chan testResult, 1)
+		go func(tc testCase, out chan<- testResult) {
+			if err := limiter.Wait(ctx); err != nil {
+				out <- testResult{Name: tc.name, Detail: "overall deadline exceeded"}
+				return
+			}
+			out <- runTest(tc)
+		}(tc, done[i])
+	}
+
+	results := make([]testResult, len(tests))
+	for i, tc := range tests {
+		select {
+		case results[i] = <-done[i]:
+		case <-ctx.Done():
+			results[i] = testResult{Name: tc.name, Detail: "overall deadline exceeded"}
+		}
+	}
+	return results
+}
+
+// reporter prints test outcomes to out as text or JSON
+type reporter struct {
+	out     io.Writer
+	json    bool
+	results []testResult
+}
+
+func (r *reporter) begin(name string) {
+	if !r.json {
+		fmt.Fprintf(r.out, "Testing %s... ", name)
+	}
+}
+
+func (r *reporter) record(result testResult) {
+	r.results = append(r.results, result)
+	if r.json {
+		return
+	}
+	if result.Passed {
+		fmt.Fprintln(r.out, "✓")
+	} else {
+		fmt.Fprintf(r.out, "✗ (%s)\n", result.Detail)
+	}
+}
+
+func (r *reporter) failed() int {
+	failed := 0
+	for _, result := range r.results {
+		if !result.Passed {
+			failed++
+		}
+	}
+	return failed
+}
+
+func (r *reporter) summary() {
+	total := len(r.results)
+	passed := total - r.failed()
+	if !r.json {
+		fmt.Fprintf(r.out, "\nTests passed: %d/%d\n", passed, total)
+		return
+	}
+	out := map[string]interface{}{
+		"tests": r.results,
+		"summary": map[string]int{
+			"passed": passed,
+			"failed": total - passed,
+			"total":  total,
+		},
+	}
+	enc := json.NewEncoder(r.out)
+	enc.SetIndent("", "  ")
+	enc.Encode(out)
+}
 
 // extractLLMResponse extracts just the LLM response from various formats
 func extractLLMResponse(body string, contentType string) string {
 	body = strings.TrimSpace(body)
-	
+
 	// For error responses, return empty to fail the test
 	if strings.Contains(body, "error") || strings.Contains(body, "Error") {
 		return ""
 	}
-	
+
 	// For JSON responses
 	if strings.Contains(contentType, "json") {
 		var result map[string]string
@@ -35,7 +165,7 @@ func extractLLMResponse(body string, contentType string) string {
 		}
 		return ""
 	}
-	
+
 	// For plain text Q&A format, extract just the answer
 	if strings.Contains(body, "\nA: ") {
 		lines := strings.Split(body, "\n")
@@ -45,34 +175,31 @@ func extractLLMResponse(body string, contentType string) string {
 			}
 		}
 	}
-	
+
 	// Otherwise return trimmed body
 	return body
 }
 
-func checkResponse(resp *http.Response, err error, passed, failed *int) {
+func checkResponse(resp *http.Response, err error, c *check) {
 	if err != nil {
-		fmt.Println("✗ (request failed)")
-		*failed++
+		c.fail("request failed")
 		return
 	}
 	defer resp.Body.Close()
-	
+
 	body, _ := io.ReadAll(resp.Body)
-	
+
 	if resp.StatusCode != 200 {
-		fmt.Printf("✗ (status %d)\n", resp.StatusCode)
-		*failed++
+		c.fail("status %d", resp.StatusCode)
 		return
 	}
-	
+
 	contentType := resp.Header.Get("Content-Type")
 	llmResponse := extractLLMResponse(string(body), contentType)
-	
+
 	// Check for exact match "pass"
 	if llmResponse == "pass" {
-		fmt.Println("✓")
-		*passed++
+		c.pass()
 	} else {
 		// Show what we got instead
 		preview := llmResponse
@@ -81,303 +208,415 @@ func checkResponse(resp *http.Response, err error, passed, failed *int) {
 		} else if len(preview) > 50 {
 			preview = preview[:50] + "..."
 		}
-		fmt.Printf("✗ (expected 'pass', got: %q)\n", preview)
-		*failed++
+		c.fail("expected 'pass', got: %q", preview)
 	}
 }
 
-
-func main() {
-	if len(os.Args) < 2 {
-		fmt.Println("Usage: selftest <base-url>")
-		fmt.Println("Example: selftest http://localhost:8080")
-		os.Exit(1)
+// queryTXT asks server over UDP for the TXT records of name and returns
+// their text
+func queryTXT(server, name string, timeout time.Duration) (string, error) {
+	query := new(dns.Msg)
+	query.SetQuestion(dns.Fqdn(name), dns.TypeTXT)
+	client := &dns.Client{Timeout: timeout}
+	resp, _, err := client.Exchange(query, server)
+	if err != nil {
+		return "", fmt.Errorf("DNS query failed: %v", err)
 	}
-
-	baseURL := strings.TrimSuffix(os.Args[1], "/")
-	
-	sshPort := "22"
-	
-	// Extract hostname from URL for SSH/DNS tests
-	hostname := "localhost"
-	if u, err := url.Parse(baseURL); err == nil && u.Hostname() != "" {
-		hostname = u.Hostname()
+	if resp.Rcode != dns.RcodeSuccess {
+		return "", fmt.Errorf("DNS error: %s", dns.RcodeToString[resp.Rcode])
 	}
-	
-	passed := 0
-	failed := 0
-
-	// Add delay between tests to avoid rate limiting
-	testDelay := 700 * time.Millisecond
-
-	// Test 1: Basic HTTP GET
-	fmt.Print("Testing HTTP GET... ")
-	resp, err := http.Get(baseURL + "/?q=repeat+verbatim+the+word+pass")
-	checkResponse(resp, err, &passed, &failed)
-
-	time.Sleep(testDelay)
+	return txtText(resp), nil
+}
 
-	// Test 2: HTTP POST
-	fmt.Print("Testing HTTP POST... ")
-	resp, err = http.Post(baseURL+"/", "text/plain", strings.NewReader("repeat verbatim the word pass"))
-	checkResponse(resp, err, &passed, &failed)
+// queryDoH POSTs a wire-format TXT query for name to endpoint and returns
+// the text of the answer
+func queryDoH(client *http.Client, endpoint, name string) (string, error) {
+	query := new(dns.Msg)
+	query.SetQuestion(dns.Fqdn(name), dns.TypeTXT)
+	wire, err := query.Pack()
+	if err != nil {
+		return "", fmt.Errorf("packing query failed: %v", err)
+	}
+	resp, err := client.Post(endpoint, "application/dns-message", bytes.NewReader(wire))
+	if err != nil {
+		return "", fmt.Errorf("transport error: %v", err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != 200 {
+		return "", fmt.Errorf("transport error: status %d", resp.StatusCode)
+	}
 
-	time.Sleep(testDelay)
+	answer := new(dns.Msg)
+	if err := answer.Unpack(body); err != nil {
+		return "", fmt.Errorf("invalid DNS message in response: %v", err)
+	}
+	return txtText(answer), nil
+}
 
-	// Test 3: Path-based query
-	fmt.Print("Testing path-based query... ")
-	resp, err = http.Get(baseURL + "/repeat-verbatim-the-word-pass")
-	checkResponse(resp, err, &passed, &failed)
+// txtText joins the TXT answers in m. Long answers are split across
+// several strings in one TXT record.
+func txtText(m *dns.Msg) string {
+	var text strings.Builder
+	for _, rr := range m.Answer {
+		if txt, ok := rr.(*dns.TXT); ok {
+			text.WriteString(strings.Join(txt.Txt, ""))
+		}
+	}
+	return strings.TrimSpace(text.String())
+}
 
-	time.Sleep(testDelay)
+// options are the command-line settings of a run
+type options struct {
+	baseURL  string
+	json     bool
+	sshPort  int
+	dnsPort  int
+	delay    time.Duration
+	timeout  time.Duration // Per HTTP request; 0 means none
+	dnsWait  time.Duration
+	sshDial  time.Duration
+	sshRead  time.Duration
+	doh      bool
+	parallel bool
+	deadline time.Duration
+}
 
-	// Test 4: JSON API
-	fmt.Print("Testing JSON API... ")
-	req, _ := http.NewRequest("GET", baseURL+"/?q=repeat+verbatim+the+word+pass", nil)
-	req.Header.Set("Accept", "application/json")
-	resp, err = http.DefaultClient.Do(req)
-	if err == nil && resp.StatusCode == 200 {
-		var result map[string]string
-		json.NewDecoder(resp.Body).Decode(&result)
-		resp.Body.Close()
-		if result["question"] == "repeat verbatim the word pass" && result["answer"] == "pass" {
-			fmt.Println("✓")
-			passed++
-		} else {
-			answer := result["answer"]
-			if answer == "" {
-				answer = "no answer field"
-			}
-			fmt.Printf("✗ (expected 'pass', got: %q)\n", answer)
-			failed++
+// parseOptions reads the command line. Like the flag package, it prints
+// usage and the reason for any error it returns to out.
+func parseOptions(args []string, out io.Writer) (options, error) {
+	var o options
+	fs := flag.NewFlagSet("selftest", flag.ContinueOnError)
+	fs.SetOutput(out)
+	fs.BoolVar(&o.json, "json", false, "print results as JSON instead of text")
+	fs.IntVar(&o.sshPort, "ssh-port", 22, "SSH port of the target")
+	fs.IntVar(&o.dnsPort, "dns-port", 53, "DNS port of the target")
+	fs.DurationVar(&o.delay, "delay", 700*time.Millisecond, "pause between tests, to stay under the rate limit")
+	fs.DurationVar(&o.timeout, "timeout", 0, "timeout for each HTTP request (0 for none)")
+	fs.DurationVar(&o.dnsWait, "dns-timeout", 5*time.Second, "how long to wait for a DNS answer")
+	fs.DurationVar(&o.sshDial, "ssh-timeout", 5*time.Second, "timeout for connecting to SSH")
+	fs.DurationVar(&o.sshRead, "read-timeout", 3*time.Second, "how long to wait for the answer over SSH")
+	fs.BoolVar(&o.doh, "doh", false, "also test DNS-over-HTTPS at <base-url>/dns-query")
+	fs.BoolVar(&o.parallel, "parallel", false, "run protocol tests concurrently; rate limiting still runs last on its own")
+	fs.DurationVar(&o.deadline, "deadline", 2*time.Minute, "overall time limit for -parallel runs")
+	fs.Usage = func() {
+		fmt.Fprintln(out, "Usage: selftest [flags] <base-url>")
+		fmt.Fprintln(out, "Example: selftest http://localhost:8080")
+		fmt.Fprintln(out, "Exits nonzero if any test fails, in both output modes.")
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return o, err
+	}
+	if fs.NArg() < 1 {
+		fs.Usage()
+		return o, errors.New("missing base URL")
+	}
+	for _, p := range []struct {
+		name string
+		port int
+	}{{"ssh-port", o.sshPort}, {"dns-port", o.dnsPort}} {
+		if p.port < 1 || p.port > 65535 {
+			fmt.Fprintf(out, "Invalid -%s %d: must be between 1 and 65535\n", p.name, p.port)
+			return o, fmt.Errorf("invalid -%s %d", p.name, p.port)
 		}
-	} else {
-		fmt.Println("✗ (request failed)")
-		failed++
 	}
+	if o.delay < 0 || o.timeout < 0 {
+		fmt.Fprintln(out, "Invalid -delay or -timeout: must be >= 0")
+		return o, errors.New("invalid -delay or -timeout")
+	}
+	if o.dnsWait <= 0 || o.sshDial <= 0 || o.sshRead <= 0 || o.deadline <= 0 {
+		fmt.Fprintln(out, "Invalid -dns-timeout, -ssh-timeout, -read-timeout or -deadline: must be > 0")
+		return o, errors.New("invalid -dns-timeout, -ssh-timeout, -read-timeout or -deadline")
+	}
+	o.baseURL = strings.TrimSuffix(fs.Arg(0), "/")
+	return o, nil
+}
 
-	time.Sleep(testDelay)
+func main() {
+	opts, err := parseOptions(os.Args[1:], os.Stdout)
+	if errors.Is(err, flag.ErrHelp) {
+		os.Exit(0)
+	}
+	if err != nil {
+		os.Exit(1)
+	}
 
-	// Test 5: OpenAI API compatibility
-	fmt.Print("Testing OpenAI API... ")
-	payload := map[string]interface{}{
-		"model": "gpt-4o",
-		"messages": []map[string]string{
-			{"role": "user", "content": "repeat verbatim the word pass"},
-		},
+	baseURL := opts.baseURL
+	sshPort := strconv.Itoa(opts.sshPort)
+	dnsPort := strconv.Itoa(opts.dnsPort)
+	client := &http.Client{Timeout: opts.timeout}
+
+	// Extract hostname from URL for SSH/DNS tests
+	hostname := "localhost"
+	if u, err := url.Parse(baseURL); err == nil && u.Hostname() != "" {
+		hostname = u.Hostname()
 	}
-	jsonData, _ := json.Marshal(payload)
-	// OpenAI API is on main HTTP port when OPENAI_PORT=0
-	apiURL := baseURL + "/v1/chat/completions"
-	resp, err = http.Post(apiURL, "application/json", bytes.NewReader(jsonData))
-	if err == nil && resp.StatusCode == 200 {
-		var result map[string]interface{}
-		json.NewDecoder(resp.Body).Decode(&result)
-		resp.Body.Close()
-		if choices, ok := result["choices"].([]interface{}); ok && len(choices) > 0 {
-			if choice, ok := choices[0].(map[string]interface{}); ok {
-				if message, ok := choice["message"].(map[string]interface{}); ok {
-					if content, ok := message["content"].(string); ok {
-						content = strings.TrimSpace(content)
-						if content == "pass" {
-							fmt.Println("✓")
-							passed++
+
+	tests := []testCase{
+		// Test 1: Basic HTTP GET
+		{"HTTP GET", func(c *check) {
+			resp, err := client.Get(baseURL + "/?q=repeat+verbatim+the+word+pass")
+			checkResponse(resp, err, c)
+		}},
+		// Test 2: HTTP POST
+		{"HTTP POST", func(c *check) {
+			resp, err := client.Post(baseURL+"/", "text/plain", strings.NewReader("repeat verbatim the word pass"))
+			checkResponse(resp, err, c)
+		}},
+		// Test 3: Path-based query
+		{"path-based query", func(c *check) {
+			resp, err := client.Get(baseURL + "/repeat-verbatim-the-word-pass")
+			checkResponse(resp, err, c)
+		}},
+		// Test 4: JSON API
+		{"JSON API", func(c *check) {
+			req, _ := http.NewRequest("GET", baseURL+"/?q=repeat+verbatim+the+word+pass", nil)
+			req.Header.Set("Accept", "application/json")
+			resp, err := client.Do(req)
+			if err == nil && resp.StatusCode == 200 {
+				var result map[string]string
+				json.NewDecoder(resp.Body).Decode(&result)
+				resp.Body.Close()
+				if result["question"] == "repeat verbatim the word pass" && result["answer"] == "pass" {
+					c.pass()
+				} else {
+					answer := result["answer"]
+					if answer == "" {
+						answer = "no answer field"
+					}
+					c.fail("expected 'pass', got: %q", answer)
+				}
+			} else {
+				c.fail("request failed")
+			}
+		}},
+		// Test 5: OpenAI API compatibility
+		{"OpenAI API", func(c *check) {
+			payload := map[string]interface{}{
+				"model": "gpt-4o",
+				"messages": []map[string]string{
+					{"role": "user", "content": "repeat verbatim the word pass"},
+				},
+			}
+			jsonData, _ := json.Marshal(payload)
+			// OpenAI API is on main HTTP port when OPENAI_PORT=0
+			apiURL := baseURL + "/v1/chat/completions"
+			resp, err := client.Post(apiURL, "application/json", bytes.NewReader(jsonData))
+			if err == nil && resp.StatusCode == 200 {
+				var result map[string]interface{}
+				json.NewDecoder(resp.Body).Decode(&result)
+				resp.Body.Close()
+				if choices, ok := result["choices"].([]interface{}); ok && len(choices) > 0 {
+					if choice, ok := choices[0].(map[string]interface{}); ok {
+						if message, ok := choice["message"].(map[string]interface{}); ok {
+							if content, ok := message["content"].(string); ok {
+								content = strings.TrimSpace(content)
+								if content == "pass" {
+									c.pass()
+								} else {
+									c.fail("expected 'pass', got: %q", content)
+								}
+							} else {
+								c.fail("no content in message")
+							}
 						} else {
-							fmt.Printf("✗ (expected 'pass', got: %q)\n", content)
-							failed++
+							c.fail("invalid message format")
 						}
 					} else {
-						fmt.Println("✗ (no content in message)")
-						failed++
+						c.fail("invalid choice format")
 					}
 				} else {
-					fmt.Println("✗ (invalid message format)")
-					failed++
+					c.fail("invalid response format")
 				}
 			} else {
-				fmt.Println("✗ (invalid choice format)")
-				failed++
+				c.fail("request failed")
+			}
+		}},
+		// Test 6: SSH protocol
+		{"SSH protocol", func(c *check) {
+			config := &ssh.ClientConfig{
+				User: "anonymous",
+				Auth: []ssh.AuthMethod{
+					ssh.Password(""),
+				},
+				HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+				Timeout:         opts.sshDial,
+				ClientVersion:   "SSH-2.0-Go", // Explicitly set version
 			}
-		} else {
-			fmt.Println("✗ (invalid response format)")
-			failed++
-		}
-	} else {
-		fmt.Println("✗ (request failed)")
-		failed++
-	}
 
-	time.Sleep(testDelay)
+			// Use 127.0.0.1 instead of localhost to avoid IPv6 issues
+			sshHost := hostname
+			if hostname == "localhost" {
+				sshHost = "127.0.0.1"
+			}
 
-	// Test 6: SSH protocol
-	fmt.Print("Testing SSH protocol... ")
-	config := &ssh.ClientConfig{
-		User: "anonymous", 
-		Auth: []ssh.AuthMethod{
-			ssh.Password(""),
-		},
-		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
-		Timeout:         5 * time.Second,
-		ClientVersion:   "SSH-2.0-Go", // Explicitly set version
-	}
-	
-	// Use 127.0.0.1 instead of localhost to avoid IPv6 issues
-	sshHost := hostname
-	if hostname == "localhost" {
-		sshHost = "127.0.0.1"
-	}
-	
-	sshClient, err := ssh.Dial("tcp", sshHost+":"+sshPort, config)
-	if err == nil {
-		defer sshClient.Close()
-		
-		// Create a session and send a real query
-		session, err := sshClient.NewSession()
-		if err == nil {
-			defer session.Close()
-			
-			// Request PTY to simulate real terminal
-			if err := session.RequestPty("xterm", 80, 40, ssh.TerminalModes{}); err == nil {
-				// Set up pipes for input/output
-				stdin, _ := session.StdinPipe()
-				stdout, _ := session.StdoutPipe()
-				
-				// Start shell
-				if err := session.Shell(); err == nil {
-					// Send query
-					stdin.Write([]byte("repeat verbatim the word pass\n"))
-					stdin.Close()
-					
-					// Read response (with timeout)
-					done := make(chan bool)
-					var output []byte
-					go func() {
-						output, _ = io.ReadAll(stdout)
-						done <- true
-					}()
-					
-					select {
-					case <-done:
-						outputStr := string(output)
-						// Extract just the LLM response from SSH output
-						// Look for lines after our query
-						lines := strings.Split(outputStr, "\n")
-						llmResponse := ""
-						for i, line := range lines {
-							line = strings.TrimSpace(strings.TrimSuffix(line, "\r"))
-							// Find the line containing our query
-							if strings.Contains(line, "repeat verbatim the word pass") && i+1 < len(lines) {
-								// The response should be on the next line
-								nextLine := strings.TrimSpace(strings.TrimSuffix(lines[i+1], "\r"))
-								// Skip if it's a prompt line
-								if nextLine != "" && !strings.HasPrefix(nextLine, ">") {
-									llmResponse = nextLine
-									break
+			sshClient, err := ssh.Dial("tcp", sshHost+":"+sshPort, config)
+			if err == nil {
+				defer sshClient.Close()
+
+				// Create a session and send a real query
+				session, err := sshClient.NewSession()
+				if err == nil {
+					defer session.Close()
+
+					// Request PTY to simulate real terminal
+					if err := session.RequestPty("xterm", 80, 40, ssh.TerminalModes{}); err == nil {
+						// Set up pipes for input/output
+						stdin, _ := session.StdinPipe()
+						stdout, _ := session.StdoutPipe()
+
+						// Start shell
+						if err := session.Shell(); err == nil {
+							// Send query
+							stdin.Write([]byte("repeat verbatim the word pass\n"))
+							stdin.Close()
+
+							// Read response (with timeout)
+							done := make(chan bool)
+							var output []byte
+							go func() {
+								output, _ = io.ReadAll(stdout)
+								done <- true
+							}()
+
+							select {
+							case <-done:
+								outputStr := string(output)
+								// Extract just the LLM response from SSH output
+								// Look for lines after our query
+								lines := strings.Split(outputStr, "\n")
+								llmResponse := ""
+								for i, line := range lines {
+									line = strings.TrimSpace(strings.TrimSuffix(line, "\r"))
+									// Find the line containing our query
+									if strings.Contains(line, "repeat verbatim the word pass") && i+1 < len(lines) {
+										// The response should be on the next line
+										nextLine := strings.TrimSpace(strings.TrimSuffix(lines[i+1], "\r"))
+										// Skip if it's a prompt line
+										if nextLine != "" && !strings.HasPrefix(nextLine, ">") {
+											llmResponse = nextLine
+											break
+										}
+									}
+								}
+
+								// Check for response
+								if llmResponse == "pass" {
+									c.pass()
+								} else {
+									if llmResponse == "" {
+										llmResponse = "no response extracted"
+									}
+									c.fail("expected 'pass', got: %q", llmResponse)
 								}
+							case <-time.After(opts.sshRead):
+								c.fail("SSH timeout")
 							}
-						}
-						
-						// Check for response
-						if llmResponse == "pass" {
-							fmt.Println("✓")
-							passed++
 						} else {
-							if llmResponse == "" {
-								llmResponse = "no response extracted"
-							}
-							fmt.Printf("✗ (expected 'pass', got: %q)\n", llmResponse)
-							failed++
+							c.fail("SSH shell failed")
 						}
-					case <-time.After(3 * time.Second):
-						fmt.Println("✗ (SSH timeout)")
-						failed++
+					} else {
+						c.fail("SSH PTY failed")
 					}
 				} else {
-					fmt.Println("✗ (SSH shell failed)")
-					failed++
+					c.fail("SSH session failed")
+				}
+			} else {
+				// Try to understand the error
+				if strings.Contains(err.Error(), "handshake failed") {
+					c.fail("SSH handshake failed - server may require different auth")
+				} else {
+					c.fail("SSH failed: %v", err)
 				}
+			}
+		}},
+		// Test 7: DNS protocol
+		{"DNS protocol", func(c *check) {
+			// For localhost, use the query directly without domain suffix
+			var queryDomain string
+			if hostname == "localhost" || hostname == "127.0.0.1" {
+				queryDomain = "repeat-verbatim-the-word-pass"
 			} else {
-				fmt.Println("✗ (SSH PTY failed)")
-				failed++
+				queryDomain = "repeat-verbatim-the-word-pass." + hostname
 			}
-		} else {
-			fmt.Println("✗ (SSH session failed)")
-			failed++
-		}
-	} else {
-		// Try to understand the error
-		if strings.Contains(err.Error(), "handshake failed") {
-			fmt.Println("✗ (SSH handshake failed - server may require different auth)")
-		} else {
-			fmt.Printf("✗ (SSH failed: %v)\n", err)
-		}
-		failed++
+			outputStr, err := queryTXT(net.JoinHostPort(hostname, dnsPort), queryDomain, opts.dnsWait)
+			if err != nil {
+				c.fail("%v", err)
+			} else if outputStr == "pass" {
+				c.pass()
+			} else {
+				if outputStr == "" {
+					outputStr = "empty response"
+				}
+				c.fail("expected 'pass', got: %q", outputStr)
+			}
+		}},
 	}
 
-	time.Sleep(testDelay)
-
-	// Test 7: DNS protocol
-	fmt.Print("Testing DNS protocol... ")
-	// Run dig command to query the DNS server
-	// For localhost, use the query directly without domain suffix
-	var queryDomain string
-	if hostname == "localhost" || hostname == "127.0.0.1" {
-		queryDomain = "repeat-verbatim-the-word-pass"
-	} else {
-		queryDomain = "repeat-verbatim-the-word-pass." + hostname
-	}
-	cmd := exec.Command("dig", "+short", "@"+hostname, "-p", "53", queryDomain, "TXT")
-	output, err := cmd.Output()
-	if err != nil {
-		fmt.Printf("✗ (dig command failed: %v)\n", err)
-		failed++
-	} else {
-		outputStr := strings.TrimSpace(string(output))
-		// DNS TXT records come with quotes, remove them
-		outputStr = strings.Trim(outputStr, "\"")
-		
-		// Check for response
-		if outputStr == "pass" {
-			fmt.Println("✓")
-			passed++
-		} else {
-			if outputStr == "" {
-				outputStr = "empty response"
+	// Test 8: DNS-over-HTTPS, only when the target serves it
+	if opts.doh {
+		tests = append(tests, testCase{"DNS-over-HTTPS", func(c *check) {
+			got, err := queryDoH(client, baseURL+"/dns-query", "repeat-verbatim-the-word-pass")
+			if err != nil {
+				c.fail("%v", err)
+				return
 			}
-			fmt.Printf("✗ (expected 'pass', got: %q)\n", outputStr)
-			failed++
-		}
+			if got != "pass" {
+				if got == "" {
+					got = "empty response"
+				}
+				c.fail("wrong answer: expected 'pass', got: %q", got)
+				return
+			}
+			c.pass()
+		}})
 	}
 
-	time.Sleep(testDelay)
-
-	// Test 8: Rate limiting (default is 100 requests/minute)
-	fmt.Print("Testing rate limiting... ")
-	rateLimitHit := false
-	// Make requests quickly to trigger rate limit
-	// Use empty query to avoid LLM calls
-	for i := 0; i < 110; i++ {
-		resp, err := http.Get(baseURL + "/")
-		if err == nil {
-			if resp.StatusCode == 429 {
-				rateLimitHit = true
+	// Test 9: Rate limiting (default is 100 requests/minute)
+	// Runs last and on its own, since it deliberately exhausts the limit
+	rateLimitTest := testCase{"rate limiting", func(c *check) {
+		rateLimitHit := false
+		// Make requests quickly to trigger rate limit
+		// Use empty query to avoid LLM calls
+		for i := 0; i < 110; i++ {
+			resp, err := client.Get(baseURL + "/")
+			if err == nil {
+				if resp.StatusCode == 429 {
+					rateLimitHit = true
+					resp.Body.Close()
+					break
+				}
 				resp.Body.Close()
-				break
 			}
-			resp.Body.Close()
 		}
-	}
-	if rateLimitHit {
-		fmt.Println("✓")
-		passed++
+		if rateLimitHit {
+			c.pass()
+		} else {
+			c.fail("rate limit not enforced")
+		}
+	}}
+
+	rep := &reporter{out: os.Stdout, json: opts.json}
+	if opts.parallel {
+		limiter := rate.NewLimiter(rate.Every(opts.delay), 1)
+		for _, result := range runConcurrently(tests, limiter, opts.deadline) {
+			rep.begin(result.Name)
+			rep.record(result)
+		}
 	} else {
-		fmt.Println("✗ (rate limit not enforced)")
-		failed++
+		for _, tc := range tests {
+			rep.begin(tc.name)
+			rep.record(runTest(tc))
+			time.Sleep(opts.delay)
+		}
 	}
+	rep.begin(rateLimitTest.name)
+	rep.record(runTest(rateLimitTest))
 
 	// Summary
-	fmt.Printf("\nTests passed: %d/%d\n", passed, passed+failed)
-	if failed > 0 {
+	rep.summary()
+	if rep.failed() > 0 {
 		os.Exit(1)
 	}
-}
\ No newline at end of file
+}
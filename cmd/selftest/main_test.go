@@ -0,0 +1,347 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"golang.org/x/time/rate"
+)
+
+func TestReporterJSON(t *testing.T) {
+	var out bytes.Buffer
+	rep := &reporter{out: &out, json: true}
+	rep.begin("first")
+	rep.record(testResult{Name: "first", Passed: true, DurationMS: 12})
+	rep.begin("second")
+	rep.record(testResult{Name: "second", Detail: "status 500", DurationMS: 3})
+	rep.summary()
+
+	var got struct {
+		Tests   []testResult   `json:"tests"`
+		Summary map[string]int `json:"summary"`
+	}
+	if err := json.Unmarshal(out.Bytes(), &got); err != nil {
+		t.Fatalf("output %q is not one JSON document: %v", out.String(), err)
+	}
+	want := []testResult{
+		{Name: "first", Passed: true, DurationMS: 12},
+		{Name: "second", Detail: "status 500", DurationMS: 3},
+	}
+	if len(got.Tests) != len(want) || got.Tests[0] != want[0] || got.Tests[1] != want[1] {
+		t.Errorf("tests = %+v, want %+v", got.Tests, want)
+	}
+	if got.Summary["passed"] != 1 || got.Summary["failed"] != 1 || got.Summary["total"] != 2 {
+		t.Errorf("summary = %v", got.Summary)
+	}
+	if rep.failed() != 1 {
+		t.Errorf("failed() = %d, want 1", rep.failed())
+	}
+}
+
+func TestReporterText(t *testing.T) {
+	var out bytes.Buffer
+	rep := &reporter{out: &out}
+	rep.begin("first")
+	rep.record(testResult{Name: "first", Passed: true})
+	rep.begin("second")
+	rep.record(testResult{Name: "second", Detail: "status 500"})
+	rep.summary()
+
+	for _, want := range []string{"Testing first... ✓\n", "Testing second... ✗ (status 500)\n", "Tests passed: 1/2\n"} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("output %q lacks %q", out.String(), want)
+		}
+	}
+}
+
+func TestParseOptionsDefaults(t *testing.T) {
+	var out bytes.Buffer
+	o, err := parseOptions([]string{"http://localhost:8080/"}, &out)
+	if err != nil {
+		t.Fatalf("parseOptions: %v (output %q)", err, out.String())
+	}
+	want := options{
+		baseURL:  "http://localhost:8080",
+		sshPort:  22,
+		dnsPort:  53,
+		delay:    700 * time.Millisecond,
+		dnsWait:  5 * time.Second,
+		sshDial:  5 * time.Second,
+		sshRead:  3 * time.Second,
+		deadline: 2 * time.Minute,
+	}
+	if o != want {
+		t.Errorf("options = %+v, want %+v", o, want)
+	}
+}
+
+func TestParseOptionsFlags(t *testing.T) {
+	o, err := parseOptions([]string{
+		"-json", "-doh", "-parallel", "-ssh-port", "2222", "-dns-port", "5353",
+		"-delay", "0", "-timeout", "5s", "-dns-timeout", "2s", "-ssh-timeout", "10s",
+		"-read-timeout", "20s", "-deadline", "1m", "https://ch.at",
+	}, io.Discard)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := options{
+		baseURL:  "https://ch.at",
+		json:     true,
+		sshPort:  2222,
+		dnsPort:  5353,
+		timeout:  5 * time.Second,
+		dnsWait:  2 * time.Second,
+		sshDial:  10 * time.Second,
+		sshRead:  20 * time.Second,
+		doh:      true,
+		parallel: true,
+		deadline: time.Minute,
+	}
+	if o != want {
+		t.Errorf("options = %+v, want %+v", o, want)
+	}
+}
+
+func TestParseOptionsRejects(t *testing.T) {
+	for _, tc := range []struct {
+		args []string
+		says string
+	}{
+		{nil, "Usage:"},
+		{[]string{"-ssh-port", "0", "http://x"}, "Invalid -ssh-port 0"},
+		{[]string{"-dns-port", "65536", "http://x"}, "Invalid -dns-port 65536"},
+		{[]string{"-delay", "-1s", "http://x"}, "Invalid -delay"},
+		{[]string{"-timeout", "-1s", "http://x"}, "Invalid -delay or -timeout"},
+		{[]string{"-read-timeout", "0", "http://x"}, "Invalid -dns-timeout"},
+		{[]string{"-deadline", "0", "http://x"}, "Invalid -dns-timeout"},
+		{[]string{"-timeout", "soon", "http://x"}, "invalid value"},
+		{[]string{"-nope", "http://x"}, "not defined"},
+	} {
+		var out bytes.Buffer
+		if _, err := parseOptions(tc.args, &out); err == nil {
+			t.Errorf("parseOptions(%q) succeeded", tc.args)
+		} else if !strings.Contains(out.String(), tc.says) {
+			t.Errorf("parseOptions(%q) printed %q, want it to mention %q", tc.args, out.String(), tc.says)
+		}
+	}
+}
+
+func TestParseOptionsHelp(t *testing.T) {
+	var out bytes.Buffer
+	if _, err := parseOptions([]string{"-h"}, &out); !errors.Is(err, flag.ErrHelp) {
+		t.Errorf("err = %v, want flag.ErrHelp", err)
+	}
+	if !strings.Contains(out.String(), "Usage: selftest") {
+		t.Errorf("help printed %q", out.String())
+	}
+}
+
+// serveDNS answers UDP queries on a local port with h until the test ends
+func serveDNS(t *testing.T, h dns.HandlerFunc) string {
+	t.Helper()
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	started := make(chan struct{})
+	srv := &dns.Server{PacketConn: pc, Handler: h, NotifyStartedFunc: func() { close(started) }}
+	go srv.ActivateAndServe()
+	<-started
+	t.Cleanup(func() { srv.Shutdown() })
+	return pc.LocalAddr().String()
+}
+
+func TestQueryTXT(t *testing.T) {
+	asked := make(chan string, 1)
+	addr := serveDNS(t, func(w dns.ResponseWriter, r *dns.Msg) {
+		asked <- r.Question[0].Name
+		m := new(dns.Msg)
+		m.SetReply(r)
+		hdr := dns.RR_Header{Name: r.Question[0].Name, Rrtype: dns.TypeTXT, Class: dns.ClassINET, Ttl: 60}
+		m.Answer = append(m.Answer, &dns.TXT{Hdr: hdr, Txt: []string{"pa", "ss "}})
+		w.WriteMsg(m)
+	})
+
+	got, err := queryTXT(addr, "repeat-verbatim-the-word-pass", time.Second)
+	if err != nil || got != "pass" {
+		t.Errorf("queryTXT = %q, %v; want pass", got, err)
+	}
+	if name := <-asked; name != "repeat-verbatim-the-word-pass." {
+		t.Errorf("server was asked for %q", name)
+	}
+}
+
+func TestQueryTXTReportsRcode(t *testing.T) {
+	addr := serveDNS(t, func(w dns.ResponseWriter, r *dns.Msg) {
+		m := new(dns.Msg)
+		m.SetRcode(r, dns.RcodeRefused)
+		w.WriteMsg(m)
+	})
+
+	if _, err := queryTXT(addr, "pass", time.Second); err == nil || !strings.Contains(err.Error(), "REFUSED") {
+		t.Errorf("err = %v, want it to name REFUSED", err)
+	}
+}
+
+func TestQueryTXTTimesOut(t *testing.T) {
+	// Bound but never read, so the query goes unanswered
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+
+	if _, err := queryTXT(pc.LocalAddr().String(), "pass", 50*time.Millisecond); err == nil || !strings.Contains(err.Error(), "DNS query failed") {
+		t.Errorf("err = %v, want a failed query", err)
+	}
+}
+
+func TestRunConcurrentlyKeepsOrder(t *testing.T) {
+	var tests []testCase
+	for i := 0; i < 5; i++ {
+		delay := time.Duration(5-i) * 10 * time.Millisecond
+		tests = append(tests, testCase{fmt.Sprint("test ", i), func(c *check) {
+			time.Sleep(delay)
+			c.pass()
+		}})
+	}
+
+	results := runConcurrently(tests, rate.NewLimiter(rate.Inf, 1), time.Second)
+	for i, result := range results {
+		if want := fmt.Sprint("test ", i); result.Name != want || !result.Passed {
+			t.Errorf("results[%d] = %+v, want %s passed", i, result, want)
+		}
+	}
+}
+
+func TestRunConcurrentlyDeadline(t *testing.T) {
+	release := make(chan struct{})
+	defer close(release)
+	tests := []testCase{
+		{"quick", func(c *check) { c.pass() }},
+		{"stuck", func(c *check) { <-release }},
+	}
+
+	start := time.Now()
+	results := runConcurrently(tests, rate.NewLimiter(rate.Inf, 1), 50*time.Millisecond)
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("returned after %s, well past the deadline", elapsed)
+	}
+	if !results[0].Passed {
+		t.Errorf("quick test = %+v, want passed", results[0])
+	}
+	if results[1].Passed || results[1].Name != "stuck" || results[1].Detail != "overall deadline exceeded" {
+		t.Errorf("stuck test = %+v, want it failed at the deadline", results[1])
+	}
+}
+
+func TestRunConcurrentlyRespectsLimiter(t *testing.T) {
+	var mu sync.Mutex
+	var starts []time.Time
+	var tests []testCase
+	for i := 0; i < 3; i++ {
+		tests = append(tests, testCase{fmt.Sprint("test ", i), func(c *check) {
+			mu.Lock()
+			starts = append(starts, time.Now())
+			mu.Unlock()
+			c.pass()
+		}})
+	}
+
+	gap := 30 * time.Millisecond
+	runConcurrently(tests, rate.NewLimiter(rate.Every(gap), 1), time.Second)
+	if len(starts) != 3 {
+		t.Fatalf("%d tests started, want 3", len(starts))
+	}
+	sort.Slice(starts, func(i, j int) bool { return starts[i].Before(starts[j]) })
+	// Allow some slack for timer granularity
+	if spread := starts[2].Sub(starts[0]); spread < 2*gap*3/4 {
+		t.Errorf("three starts within %s, want them about %s apart", spread, gap)
+	}
+}
+
+func TestRunConcurrentlyLimiterPastDeadline(t *testing.T) {
+	ran := make(chan string, 2)
+	tests := []testCase{
+		{"first", func(c *check) { ran <- "first"; c.pass() }},
+		{"second", func(c *check) { ran <- "second"; c.pass() }},
+	}
+
+	// The second start would come long after the deadline
+	results := runConcurrently(tests, rate.NewLimiter(rate.Every(time.Hour), 1), 50*time.Millisecond)
+	passed := 0
+	for _, result := range results {
+		if result.Passed {
+			passed++
+		} else if result.Detail != "overall deadline exceeded" {
+			t.Errorf("%s failed with %q", result.Name, result.Detail)
+		}
+	}
+	if passed != 1 || len(ran) != 1 {
+		t.Errorf("%d passed and %d ran, want just one of each", passed, len(ran))
+	}
+}
+
+func TestQueryDoH(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost || r.Header.Get("Content-Type") != "application/dns-message" {
+			http.Error(w, "want a DNS message", http.StatusUnsupportedMediaType)
+			return
+		}
+		body, _ := io.ReadAll(r.Body)
+		query := new(dns.Msg)
+		if err := query.Unpack(body); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		m := new(dns.Msg)
+		m.SetReply(query)
+		hdr := dns.RR_Header{Name: query.Question[0].Name, Rrtype: dns.TypeTXT, Class: dns.ClassINET, Ttl: 60}
+		m.Answer = append(m.Answer, &dns.TXT{Hdr: hdr, Txt: []string{"pass"}})
+		wire, _ := m.Pack()
+		w.Header().Set("Content-Type", "application/dns-message")
+		w.Write(wire)
+	}))
+	defer srv.Close()
+
+	got, err := queryDoH(srv.Client(), srv.URL+"/dns-query", "repeat-verbatim-the-word-pass")
+	if err != nil || got != "pass" {
+		t.Errorf("queryDoH = %q, %v; want pass", got, err)
+	}
+}
+
+func TestQueryDoHErrors(t *testing.T) {
+	notFound := httptest.NewServer(http.NotFoundHandler())
+	defer notFound.Close()
+	garbage := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("not a DNS message"))
+	}))
+	defer garbage.Close()
+	closed := httptest.NewServer(http.NotFoundHandler())
+	closed.Close()
+
+	for _, tc := range []struct {
+		name, url, want string
+	}{
+		{"status", notFound.URL, "transport error: status 404"},
+		{"unreachable", closed.URL, "transport error:"},
+		{"garbage", garbage.URL, "invalid DNS message"},
+	} {
+		if _, err := queryDoH(http.DefaultClient, tc.url+"/dns-query", "pass"); err == nil || !strings.HasPrefix(err.Error(), tc.want) {
+			t.Errorf("%s: err = %v, want %q", tc.name, err, tc.want)
+		}
+	}
+}
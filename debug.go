@@ -0,0 +1,52 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"net/http"
+)
+
+// /debug/prompt takes the same requests as / and shows the prompt that would
+// be sent upstream, after history, instructions and any system message, but
+// never calls the model. Off by default; it reveals the server's instructions.
+const (
+	debugPrompt      = false
+	debugPromptToken = "" // If set, requests need "Authorization: Bearer <token>"
+)
+
+type echoPromptKey struct{}
+
+// echoPromptRequested reports whether handleRoot should show its prompt
+// instead of answering it
+func echoPromptRequested(ctx context.Context) bool {
+	echo, _ := ctx.Value(echoPromptKey{}).(bool)
+	return echo
+}
+
+func handleDebugPrompt(w http.ResponseWriter, r *http.Request) {
+	if !debugPrompt {
+		http.NotFound(w, r)
+		return
+	}
+	auth := []byte(r.Header.Get("Authorization"))
+	if debugPromptToken != "" && subtle.ConstantTimeCompare(auth, []byte("Bearer "+debugPromptToken)) != 1 {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	r = r.Clone(context.WithValue(r.Context(), echoPromptKey{}, true))
+	r.URL.Path = "/" // Not a path-based question
+	handleRoot(w, r)
+}
+
+// writePromptEcho sends what handleRoot would have asked the model
+func writePromptEcho(w http.ResponseWriter, model, system, prompt string) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(struct {
+		Model  string `json:"model,omitempty"`
+		System string `json:"system,omitempty"`
+		Prompt string `json:"prompt"`
+	}{model, system, prompt})
+}
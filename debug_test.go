@@ -0,0 +1,73 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+// echoPrompt runs r through handleRoot as /debug/prompt does and decodes
+// the prompt it shows
+func echoPrompt(t *testing.T, r *http.Request) (model, system, prompt string) {
+	t.Helper()
+	r = r.WithContext(context.WithValue(r.Context(), echoPromptKey{}, true))
+	w := serve(handleRoot, r)
+	var echo struct{ Model, System, Prompt string }
+	if err := json.Unmarshal(w.Body.Bytes(), &echo); err != nil || w.Code != http.StatusOK {
+		t.Fatalf("status %d, body %q: %v", w.Code, w.Body.String(), err)
+	}
+	return echo.Model, echo.System, echo.Prompt
+}
+
+func TestPromptEchoMatchesPipeline(t *testing.T) {
+	refuseLLM(t)
+	history := []exchange{{"What is DNS?", "A name system."}}
+	form := url.Values{"q": {"Who made it?"}, "h": {encodeHistory(history)}, "verbosity": {"long"}, "lang": {"de"}}
+
+	r := newTestRequest("POST", "/?format=text", strings.NewReader(form.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	_, _, prompt := echoPrompt(t, r)
+	want := shapePrompt("http", transcript(history)+"Q: Who made it?", promptOptions{verbosity: "long", lang: "de"})
+	if prompt != want {
+		t.Errorf("text prompt %q, want %q", prompt, want)
+	}
+
+	// Web pages get their own pipeline
+	r = newTestRequest("GET", "/?q=hi", nil)
+	r.Header.Set("User-Agent", firefoxUA)
+	if _, _, prompt := echoPrompt(t, r); prompt != shapePrompt("html", "hi", promptOptions{}) {
+		t.Errorf("web prompt %q", prompt)
+	}
+
+	// Raw mode shows the question alone
+	if _, _, prompt := echoPrompt(t, newTestRequest("GET", "/?q=hi&lang=de&raw=1", nil)); prompt != "hi" {
+		t.Errorf("raw prompt %q, want %q", prompt, "hi")
+	}
+}
+
+func TestPromptEchoSystemAndModel(t *testing.T) {
+	refuseLLM(t)
+	old := protocolModels
+	protocolModels = map[string]string{"http": "web-model"}
+	t.Cleanup(func() { protocolModels = old })
+
+	r := newTestRequest("POST", "/", strings.NewReader(`{"q":"hi","system":"Be brief."}`))
+	r.Header.Set("Content-Type", "application/json")
+	model, system, prompt := echoPrompt(t, r)
+	if model != "web-model" || system != "Be brief." || prompt != "hi" {
+		t.Errorf("model %q, system %q, prompt %q", model, system, prompt)
+	}
+}
+
+func TestDebugPromptOff(t *testing.T) {
+	if debugPrompt {
+		t.Skip("debugPrompt is on")
+	}
+	refuseLLM(t)
+	if w := serve(handleDebugPrompt, newTestRequest("GET", "/debug/prompt?q=hi", nil)); w.Code != http.StatusNotFound {
+		t.Errorf("status %d, want 404 while off", w.Code)
+	}
+}
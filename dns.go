@@ -1,27 +1,145 @@
 package main
 
 import (
+	"context"
+	"crypto/rand"
+	"encoding/base32"
+	"encoding/hex"
+	"errors"
 	"fmt"
+	"log"
+	"net"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
+	"unicode/utf8"
 
 	"github.com/miekg/dns"
 )
 
-func StartDNSServer(port int) error {
+// DNS answer shaping - edit and recompile to change
+const (
+	dnsMaxCharsEDNS0 = 3000            // Upper bound for larger buffers and TCP
+	dnsUDPSize       = 1232            // UDP buffer advertised in our OPT record (DNS flag day 2020)
+	dnsDeadline      = 4 * time.Second // Safe middle ground for DNS clients
+	dnsTTL           = 60              // Seconds resolvers may cache an answer (0 for always fresh)
+	dnsMaxPrompt     = 200             // Longest question accepted, in bytes after decoding
+	dnsMaxConcurrent = 100             // Queries being answered at once; beyond this, SERVFAIL
+
+	// Liveness check for monitoring: an A query for this name (e.g.
+	// "ping.ch.at") gets dnsPingAddr without asking the model ("" disables)
+	dnsPingName = ""
+	dnsPingAddr = "127.0.0.1"
+
+	// Names starting with this marker carry the question as unpadded base32
+	// (RFC 4648), split across as many labels as needed, so it can contain
+	// punctuation and any UTF-8: b32-<label>.<label>.ch.at
+	dnsBase32Prefix = "b32-"
+)
+
+// Answers longer than one response stay readable for a while: the reply ends
+// with "(more: <id>-<offset>.more.ch.at)" and that name returns the next part.
+// The offset is part of the name, so resolver caching can't serve a stale page.
+const (
+	dnsGenerateTimeout  = 30 * time.Second // How long the model keeps writing after the first reply
+	dnsContinuationTTL  = 5 * time.Minute  // How long the rest of an answer is kept
+	dnsMaxContinuations = 1000             // Answers kept at once; beyond this, the oldest is dropped (0 keeps none)
+	dnsMaxGenerating    = 100              // Answers still being written after their first reply; beyond this, long answers are cut off
+	dnsMoreReserve      = 48               // Bytes reserved for the "(more: ...)" pointer
+	dnsMinAnswer        = 64               // Shortest room worth asking the model for; below it, TC
+)
+
+var dnsBase32 = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+var dnsSlots = make(chan struct{}, dnsMaxConcurrent)
+
+// dnsGenerating holds a slot for each continuation whose model is still
+// writing, separately from the queries in dnsSlots
+var dnsGenerating = make(chan struct{}, dnsMaxGenerating)
+
+type dnsContinuation struct {
+	mu      sync.Mutex
+	text    strings.Builder
+	done    bool
+	err     error         // Why the model stopped short, once done
+	changed chan struct{} // Closed and replaced on every update
+}
+
+// dnsContinuations maps ids to *dnsContinuation. The Store only holds the
+// pointer: the answer keeps growing, and readers wait on it, while the model
+// is still writing. A continuation the Store drops keeps reading its stream,
+// unseen, until dnsGenerateTimeout stops the model.
+var dnsContinuations Store = newMemoryStore(dnsMaxContinuations)
+
+// dnsQueryText turns a query name, minus the zone, into the question text.
+// A name with nothing to ask is an error, so it doesn't spend a model call.
+func dnsQueryText(name string) (string, error) {
+	text := strings.ReplaceAll(name, "-", " ")
+	if strings.HasPrefix(strings.ToLower(name), dnsBase32Prefix) {
+		// Resolvers may change the case of names, so decode case-insensitively
+		encoded := strings.ToUpper(strings.ReplaceAll(name[len(dnsBase32Prefix):], ".", ""))
+		raw, err := dnsBase32.DecodeString(strings.TrimRight(encoded, "="))
+		if err != nil || !utf8.Valid(raw) {
+			return "", errors.New("invalid base32 query")
+		}
+		text = string(raw)
+	}
+	if strings.TrimSpace(text) == "" {
+		return "", errors.New("empty query")
+	}
+	return text, nil
+}
+
+// dnsMessageSize is the largest response the client can take: 64KB over
+// TCP, the smaller of both sides' EDNS0 buffers, or 512 bytes without EDNS0.
+func dnsMessageSize(w dns.ResponseWriter, r *dns.Msg) int {
+	if w.RemoteAddr().Network() == "tcp" {
+		return dns.MaxMsgSize
+	}
+	opt := r.IsEdns0()
+	if opt == nil {
+		return dns.MinMsgSize
+	}
+	return max(min(int(opt.UDPSize()), dnsUDPSize), dns.MinMsgSize)
+}
+
+// dnsAnswerLimit is the longest answer that fits in a reply of size bytes
+// once m's header, question and OPT record and the TXT record's own
+// overhead are counted, capped at dnsMaxCharsEDNS0
+func dnsAnswerLimit(m *dns.Msg, size int) int {
+	probe := m.Copy()
+	probe.Answer = []dns.RR{dnsTXT(m.Question[0].Name, "")}
+	room := size - probe.Len()
+	// Each 255-byte character-string of the answer adds a length byte
+	return max(min(room-(room+255)/256, dnsMaxCharsEDNS0), 0)
+}
+
+func init() {
+	if dnsPingName != "" && net.ParseIP(dnsPingAddr).To4() == nil {
+		log.Fatalf("DNS configuration: dnsPingAddr %q is not an IPv4 address", dnsPingAddr)
+	}
+}
+
+func StartDNSServer(addr string) error {
 	dns.HandleFunc("ch.at.", handleDNS)
 	dns.HandleFunc(".", handleDNS)
 
-	server := &dns.Server{
-		Addr: fmt.Sprintf(":%d", port),
-		Net:  "udp",
+	// TCP is needed for resolvers retrying truncated answers
+	errs := make(chan error, 2)
+	for _, network := range []string{"udp", "tcp"} {
+		server := &dns.Server{
+			Addr: addr,
+			Net:  network,
+		}
+		go func() { errs <- server.ListenAndServe() }()
 	}
 
-	return server.ListenAndServe()
+	return <-errs
 }
 
 func handleDNS(w dns.ResponseWriter, r *dns.Msg) {
-	if !rateLimitAllow(w.RemoteAddr().String()) {
+	if !rateLimitAllow(w.RemoteAddr().String()) || !modelRateAllow(w.RemoteAddr().String(), protocolModels["dns"]) {
 		return
 	}
 
@@ -33,81 +151,390 @@ func handleDNS(w dns.ResponseWriter, r *dns.Msg) {
 	m.SetReply(r)
 	m.Authoritative = true
 
-	for _, q := range r.Question {
-		if q.Qtype != dns.TypeTXT {
-			continue
+	// Only one question per message is answered; resolvers never send more,
+	// and each one is a full LLM call that would share the deadline.
+	if len(r.Question) > 1 {
+		m.Rcode = dns.RcodeRefused
+		w.WriteMsg(m)
+		return
+	}
+
+	if a := dnsPingAnswer(r.Question[0], dnsPingName, dnsPingAddr); a != nil {
+		m.Answer = append(m.Answer, a)
+		w.WriteMsg(m)
+		return
+	}
+
+	// Advertise our buffer to EDNS0 clients
+	if r.IsEdns0() != nil {
+		m.SetEdns0(dnsUDPSize, false)
+	}
+	size := dnsMessageSize(w, r)
+	limit := dnsAnswerLimit(m, size)
+
+	// A long name can leave almost no room for the answer in a small UDP
+	// reply; TC makes the client ask again over TCP, where there is plenty
+	if r.Question[0].Qtype == dns.TypeTXT && limit < dnsMinAnswer {
+		m.Truncated = true
+		w.WriteMsg(m)
+		return
+	}
+
+	// Each query may hold an LLM call for up to dnsDeadline, so a flood of
+	// them is turned away instead of queueing more calls. A long answer
+	// still being written after the reply counts against dnsGenerating instead.
+	select {
+	case dnsSlots <- struct{}{}:
+	default:
+		m.Rcode = dns.RcodeServerFailure
+		w.WriteMsg(m)
+		return
+	}
+	defer func() { <-dnsSlots }()
+
+	if txt := dnsAnswer(r.Question[0], limit); txt != nil {
+		m.Answer = append(m.Answer, txt)
+	}
+
+	// Sets TC if the answer still doesn't fit
+	m.Truncate(size)
+	w.WriteMsg(m)
+}
+
+// dnsPingAnswer returns the fixed answer to q if it is the liveness check,
+// an A query for name (case-insensitively), or nil. An empty name disables it.
+func dnsPingAnswer(q dns.Question, name, addr string) *dns.A {
+	if name == "" || q.Qtype != dns.TypeA || !strings.EqualFold(q.Name, dns.Fqdn(name)) {
+		return nil
+	}
+	return &dns.A{
+		Hdr: dns.RR_Header{Name: q.Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 0},
+		A:   net.ParseIP(addr),
+	}
+}
+
+// dnsAnswer asks the model a TXT question, or returns nil for other types
+func dnsAnswer(q dns.Question, limit int) *dns.TXT {
+	if q.Qtype != dns.TypeTXT {
+		return nil
+	}
+
+	name := strings.TrimSuffix(strings.TrimSuffix(q.Name, "."), ".ch.at")
+	if token, ok := strings.CutSuffix(strings.ToLower(name), ".more"); ok {
+		return dnsContinue(q.Name, token, limit)
+	}
+	// A .raw label sends the question without any of our instructions
+	raw := strings.HasSuffix(strings.ToLower(name), ".raw")
+	if raw {
+		name = name[:len(name)-len(".raw")]
+	}
+	level := "short"
+	for l := range verbosityHints {
+		if rest, ok := strings.CutSuffix(strings.ToLower(name), "."+l); ok {
+			name, level = name[:len(rest)], l
+			break
 		}
+	}
+	prompt, err := dnsQueryText(name)
+	if err != nil {
+		return dnsTXT(q.Name, err.Error())
+	}
+	if len(prompt) > dnsMaxPrompt {
+		return dnsTXT(q.Name, fmt.Sprintf("Question too long: the limit is %d bytes", dnsMaxPrompt))
+	}
+	if err := llmReady(); err != nil {
+		txt := dnsTXT(q.Name, dnsErrorText(err))
+		txt.Hdr.Ttl = 0
+		return txt
+	}
+
+	// Optimize prompt for DNS constraints
+	dnsPrompt := prompt
+	if !raw {
+		dnsPrompt = shapePrompt("dns", prompt, promptOptions{verbosity: level, limit: limit})
+	}
+
+	// Stream LLM response with hard deadline. The model may keep writing
+	// past it so the rest can be fetched with continuation queries.
+	ctx, cancel := context.WithTimeout(withProtocolModel(withRequestID(context.Background(), newRequestID()), "dns"), dnsGenerateTimeout)
+	ctx, hit := withCacheHit(ctx)
+	deadline := time.NewTimer(dnsDeadline)
+	ch := make(chan string)
+	errc := make(chan error, 1)
 
-		name := strings.TrimSuffix(strings.TrimSuffix(q.Name, "."), ".ch.at")
-		prompt := strings.ReplaceAll(name, "-", " ")
-
-		// Optimize prompt for DNS constraints
-		dnsPrompt := "Answer in 500 characters or less, no markdown formatting: " + prompt
-
-		// Stream LLM response with hard deadline
-		ch := make(chan string)
-		done := make(chan bool)
-
-		go func() {
-			LLM(dnsPrompt, ch)
-		}()
-
-		var response strings.Builder
-		deadline := time.After(4 * time.Second) // Safe middle ground for DNS clients
-		channelClosed := false
-
-		for {
-			select {
-			case chunk, ok := <-ch:
-				if !ok {
-					channelClosed = true
-					goto respond
-				}
-				response.WriteString(chunk)
-				if response.Len() >= 500 {
-					goto respond
-				}
-			case <-deadline:
-				if response.Len() == 0 {
-					response.WriteString("Request timed out")
-				} else if !channelClosed {
-					response.WriteString("... (incomplete)")
-				}
+	go func() {
+		_, err := askLLM(ctx, dnsPrompt, ch)
+		errc <- err
+	}()
+
+	var response strings.Builder
+	channelClosed := false
+	timedOut := false
+	failed := false
+
+	for {
+		select {
+		case chunk, ok := <-ch:
+			if !ok {
+				channelClosed = true
+				goto respond
+			}
+			response.WriteString(chunk)
+			if response.Len() >= limit {
 				goto respond
 			}
+		case <-deadline.C:
+			timedOut = true
+			goto respond
 		}
+	}
 
-	respond:
-		close(done)
-		finalResponse := response.String()
-		if len(finalResponse) > 500 {
-			finalResponse = finalResponse[:497] + "..."
-		} else if len(finalResponse) == 500 && !channelClosed {
-			// We hit the exact limit but stream is still going
-			finalResponse = finalResponse[:497] + "..."
+respond:
+	deadline.Stop()
+	if !channelClosed {
+		if id := storeContinuation(response.String(), ch, errc, cancel); id != "" {
+			txt := dnsTXT(q.Name, dnsPage(id, response.String(), 0, false, nil, limit))
+			dnsCapTTL(txt, hit.Expires())
+			return txt
+		}
+	}
+	if timedOut {
+		if response.Len() == 0 {
+			response.WriteString("Request timed out")
+		} else if !channelClosed {
+			response.WriteString("... (incomplete)")
+		}
+	} else if channelClosed {
+		// The stream ended early: say why instead of answering with nothing
+		if err := <-errc; err != nil {
+			failed = true
+			if response.Len() == 0 {
+				response.WriteString(dnsErrorText(err))
+			} else {
+				response.WriteString("... (incomplete)")
+			}
 		}
+	}
+	cancel()
+	finalResponse := response.String()
+	if len(finalResponse) > limit || (len(finalResponse) == limit && !channelClosed) {
+		// Over the limit, or at it with the stream still going
+		finalResponse = finalResponse[:dnsCut(finalResponse, limit-3)] + "..."
+	}
+
+	txt := dnsTXT(q.Name, finalResponse)
+	dnsCapTTL(txt, hit.Expires())
+	if failed {
+		txt.Hdr.Ttl = 0 // Don't let resolvers cache a failure
+	}
+	return txt
+}
+
+// dnsErrorText is a short, user-facing description of a backend failure
+func dnsErrorText(err error) string {
+	switch {
+	case errors.Is(err, errServerBusy):
+		return "Server busy, try again later"
+	case errors.Is(err, errNotConfigured):
+		return "Service not configured, try again later"
+	case errors.Is(err, context.DeadlineExceeded):
+		return "Request timed out"
+	default:
+		return "Error: the model backend failed, try again later"
+	}
+}
+
+// storeContinuation keeps answer and the rest of the stream for continuation
+// queries, along with the error from errc once the stream ends, and then calls
+// cancel. It returns "" if the answer can't be kept, or too many are still
+// being written.
+func storeContinuation(answer string, ch <-chan string, errc <-chan error, cancel context.CancelFunc) string {
+	if dnsMaxContinuations <= 0 {
+		return ""
+	}
+	generating := dnsGenerating
+	select {
+	case generating <- struct{}{}:
+	default:
+		return ""
+	}
+	// Lowercase hex: resolvers may change the case of names
+	b := make([]byte, 4)
+	rand.Read(b)
+	id := hex.EncodeToString(b)
+	c := &dnsContinuation{changed: make(chan struct{})}
+	c.text.WriteString(answer)
+	dnsContinuations.Set(id, c, dnsContinuationTTL)
+	if _, ok := dnsContinuations.Get(id); !ok {
+		<-generating
+		return "" // Not kept, so the answer is cut off here
+	}
+
+	go func() {
+		defer func() { <-generating }()
+		defer cancel()
+		for chunk := range ch {
+			c.update(chunk)
+		}
+		c.finish(<-errc)
+	}()
+	return id
+}
+
+func (c *dnsContinuation) update(chunk string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.text.WriteString(chunk)
+	c.notify()
+}
+
+// finish marks the answer complete, or cut short by err (a backend failure
+// or dnsGenerateTimeout)
+func (c *dnsContinuation) finish(err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.done, c.err = true, err
+	c.notify()
+}
+
+// notify wakes readers waiting for the answer to change; c.mu must be held
+func (c *dnsContinuation) notify() {
+	close(c.changed)
+	c.changed = make(chan struct{})
+}
+
+// dnsContinue answers a "<id>-<offset>" continuation query, waiting up to
+// dnsDeadline for the model to write a full page.
+func dnsContinue(name, token string, limit int) *dns.TXT {
+	id, offsetStr, _ := strings.Cut(token, "-")
+	offset, err := strconv.Atoi(offsetStr)
 
-		// Split response into 255-byte chunks for DNS TXT records
-		var txtStrings []string
-		for i := 0; i < len(finalResponse); i += 255 {
-			end := i + 255
-			if end > len(finalResponse) {
-				end = len(finalResponse)
+	value, ok := dnsContinuations.Get(id)
+	if !ok || err != nil || offset < 0 {
+		return dnsTXT(name, "Unknown or expired continuation")
+	}
+	c := value.(*dnsContinuation)
+
+	deadline := time.NewTimer(dnsDeadline)
+	defer deadline.Stop()
+	for {
+		c.mu.Lock()
+		text, done, failure, changed := c.text.String(), c.done, c.err, c.changed
+		c.mu.Unlock()
+		if offset > len(text) {
+			return dnsTXT(name, "Unknown or expired continuation")
+		}
+		if done || len(text)-offset >= limit {
+			txt := dnsTXT(name, dnsPage(id, text, offset, done, failure, limit))
+			if failure != nil {
+				txt.Hdr.Ttl = 0 // Don't let resolvers cache a cut-short answer
+			}
+			return txt
+		}
+		select {
+		case <-changed:
+		case <-deadline.C:
+			txt := dnsTXT(name, dnsPage(id, text, offset, done, nil, limit))
+			if len(text) == offset {
+				// Nothing new yet, and the same name will be asked again
+				txt.Hdr.Ttl = 0
 			}
-			txtStrings = append(txtStrings, finalResponse[i:end])
+			return txt
 		}
+	}
+}
+
+// dnsPage returns up to limit bytes of text from offset, ending with a
+// pointer to the next page unless the answer is complete. If the model
+// stopped short with err, the last page says so, as a first reply would.
+func dnsPage(id, text string, offset int, done bool, err error, limit int) string {
+	const incomplete = "... (incomplete)"
+	rest := text[offset:]
+	switch {
+	case done && err != nil && rest == "":
+		return dnsErrorText(err)
+	case done && err != nil && len(rest)+len(incomplete) <= limit:
+		return rest + incomplete
+	case done && err == nil && len(rest) <= limit:
+		return rest
+	}
+	// Without room for a pointer and some text, no page would ever advance;
+	// send it all and let the reply be truncated
+	if limit-dnsMoreReserve < utf8.UTFMax {
+		return rest
+	}
+	cut := len(rest)
+	if cut > limit-dnsMoreReserve {
+		cut = dnsCut(rest, limit-dnsMoreReserve)
+	}
+	more := fmt.Sprintf("... (more: %s-%d.more.ch.at)", id, offset+cut)
+	if cut == 0 {
+		return "Still thinking" + more
+	}
+	return rest[:cut] + more
+}
 
-		txt := &dns.TXT{
-			Hdr: dns.RR_Header{
-				Name:   q.Name,
-				Rrtype: dns.TypeTXT,
-				Class:  dns.ClassINET,
-				Ttl:    60,
-			},
-			Txt: txtStrings,
+// dnsCut returns where to cut text to fit in n bytes so it reads cleanly:
+// after the last sentence if that keeps most of it, else at the last space,
+// else at a UTF-8 boundary. This is separate from the 255-byte TXT split.
+func dnsCut(text string, n int) int {
+	if len(text) <= n {
+		return len(text)
+	}
+	if n <= 0 {
+		return 0
+	}
+	for i := n - 1; i >= n*3/4; i-- {
+		if text[i] == '\n' || strings.IndexByte(".!?", text[i]) >= 0 && text[i+1] == ' ' {
+			return i + 1
 		}
-		m.Answer = append(m.Answer, txt)
 	}
+	if i := strings.LastIndexAny(text[:n], " \t\n"); i > 0 {
+		return i
+	}
+	for n > 0 && !utf8.RuneStart(text[n]) {
+		n--
+	}
+	return n
+}
 
-	w.WriteMsg(m)
+// dnsRecordTTL is dnsTTL, capped by the response cache lifetime so resolvers
+// don't keep an answer longer than the server would.
+func dnsRecordTTL() uint32 {
+	if ttl := llmCache.ttl; ttl > 0 && int(ttl.Seconds()) < dnsTTL {
+		return uint32(ttl.Seconds())
+	}
+	return dnsTTL
+}
+
+// dnsCapTTL keeps resolvers from holding an answer served from the response
+// cache past the cache entry's own expiry (zero if it wasn't cached)
+func dnsCapTTL(txt *dns.TXT, expires time.Time) {
+	if expires.IsZero() {
+		return
+	}
+	left := uint32(max(time.Until(expires)/time.Second, 0))
+	txt.Hdr.Ttl = min(txt.Hdr.Ttl, left)
+}
+
+// dnsTXT builds a TXT record, splitting text into 255-byte strings
+func dnsTXT(name, text string) *dns.TXT {
+	var txtStrings []string
+	for i := 0; i < len(text); i += 255 {
+		end := i + 255
+		if end > len(text) {
+			end = len(text)
+		}
+		txtStrings = append(txtStrings, text[i:end])
+	}
+
+	return &dns.TXT{
+		Hdr: dns.RR_Header{
+			Name:   name,
+			Rrtype: dns.TypeTXT,
+			Class:  dns.ClassINET,
+			Ttl:    dnsRecordTTL(),
+		},
+		Txt: txtStrings,
+	}
 }
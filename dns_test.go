@@ -0,0 +1,852 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+	"unicode/utf8"
+
+	"github.com/miekg/dns"
+)
+
+// dnsRecorder is a dns.ResponseWriter that keeps the reply, for a client
+// address no other test uses
+type dnsRecorder struct {
+	remote net.Addr
+	reply  *dns.Msg
+}
+
+func newDNSRecorder(network string) *dnsRecorder {
+	host, port, _ := net.SplitHostPort(testAddr())
+	p, _ := strconv.Atoi(port)
+	if network == "tcp" {
+		return &dnsRecorder{remote: &net.TCPAddr{IP: net.ParseIP(host), Port: p}}
+	}
+	return &dnsRecorder{remote: &net.UDPAddr{IP: net.ParseIP(host), Port: p}}
+}
+
+func (w *dnsRecorder) LocalAddr() net.Addr       { return &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 53} }
+func (w *dnsRecorder) RemoteAddr() net.Addr      { return w.remote }
+func (w *dnsRecorder) WriteMsg(m *dns.Msg) error { w.reply = m; return nil }
+func (w *dnsRecorder) Write(b []byte) (int, error) {
+	w.reply = new(dns.Msg)
+	return len(b), w.reply.Unpack(b)
+}
+func (w *dnsRecorder) Close() error        { return nil }
+func (w *dnsRecorder) TsigStatus() error   { return nil }
+func (w *dnsRecorder) TsigTimersOnly(bool) {}
+func (w *dnsRecorder) Hijack()             {}
+
+// dnsQuery builds a query for name, advertising an EDNS0 buffer of
+// ednsSize bytes unless it is 0
+func dnsQuery(name string, qtype uint16, ednsSize uint16) *dns.Msg {
+	r := new(dns.Msg)
+	r.SetQuestion(dns.Fqdn(name), qtype)
+	if ednsSize > 0 {
+		r.SetEdns0(ednsSize, false)
+	}
+	return r
+}
+
+// askDNS runs r through handleDNS over network ("udp" or "tcp") and returns
+// the reply, failing the test if there is none
+func askDNS(t *testing.T, network string, r *dns.Msg) *dns.Msg {
+	t.Helper()
+	w := newDNSRecorder(network)
+	handleDNS(w, r)
+	if w.reply == nil {
+		t.Fatalf("no reply to %s", r.Question[0].Name)
+	}
+	return w.reply
+}
+
+// txtOf joins the strings of the TXT records in m
+func txtOf(m *dns.Msg) string {
+	var text strings.Builder
+	for _, rr := range m.Answer {
+		if txt, ok := rr.(*dns.TXT); ok {
+			text.WriteString(strings.Join(txt.Txt, ""))
+		}
+	}
+	return text.String()
+}
+
+// promptLimit is the character limit named in a DNS prompt
+var promptLimit = regexp.MustCompile(`\d+`)
+
+func TestDNSAnswerLimitGrowsWithBuffer(t *testing.T) {
+	m := new(dns.Msg)
+	m.SetQuestion("what-is-dns.ch.at.", dns.TypeTXT)
+	small := dnsAnswerLimit(m, dns.MinMsgSize)
+	large := dnsAnswerLimit(m, dnsUDPSize)
+	if small <= 0 || small >= dns.MinMsgSize || large <= small {
+		t.Errorf("limits %d at %d bytes and %d at %d bytes", small, dns.MinMsgSize, large, dnsUDPSize)
+	}
+	if got := dnsAnswerLimit(m, dns.MaxMsgSize); got != dnsMaxCharsEDNS0 {
+		t.Errorf("limit over TCP = %d, want the %d cap", got, dnsMaxCharsEDNS0)
+	}
+
+	// The limit is exact: an answer of that length fits and one more byte doesn't
+	m.Answer = []dns.RR{dnsTXT(m.Question[0].Name, strings.Repeat("x", small))}
+	if m.Len() > dns.MinMsgSize {
+		t.Errorf("answer of %d bytes makes a %d-byte reply", small, m.Len())
+	}
+	m.Answer = []dns.RR{dnsTXT(m.Question[0].Name, strings.Repeat("x", small+1))}
+	if m.Len() <= dns.MinMsgSize {
+		t.Errorf("limit %d is short of what fits", small)
+	}
+}
+
+func TestDNSPromptSizedToBuffer(t *testing.T) {
+	prompts := make(chan string, 1)
+	stubLLM(t, func(ctx context.Context, input interface{}, stream chan<- string) (string, error) {
+		prompts <- promptOf(input)
+		return replyWith("ok")(ctx, input, stream)
+	})
+
+	limits := make(map[string]int)
+	for _, tt := range []struct {
+		name    string
+		network string
+		edns    uint16
+	}{
+		{"plain", "udp", 0},
+		{"edns0", "udp", 4096},
+		{"tcp", "tcp", 0},
+	} {
+		askDNS(t, tt.network, dnsQuery("what-is-dns.ch.at", dns.TypeTXT, tt.edns))
+		limits[tt.name], _ = strconv.Atoi(promptLimit.FindString(<-prompts))
+	}
+	if !(0 < limits["plain"] && limits["plain"] < limits["edns0"] && limits["edns0"] < limits["tcp"]) {
+		t.Errorf("prompt limits %v, want them to grow with the reply size", limits)
+	}
+}
+
+func TestDNSLongAnswerFitsBuffer(t *testing.T) {
+	long := strings.Repeat("All work and no play. ", 60)
+	stubLLM(t, replyWith(long))
+
+	plain := askDNS(t, "udp", dnsQuery("tell-me-a-story.ch.at", dns.TypeTXT, 0))
+	if n := plain.Len(); n > dns.MinMsgSize {
+		t.Errorf("reply without EDNS0 is %d bytes, over %d", n, dns.MinMsgSize)
+	}
+	edns := askDNS(t, "udp", dnsQuery("tell-me-a-story.ch.at", dns.TypeTXT, 4096))
+	if n := edns.Len(); n > dnsUDPSize {
+		t.Errorf("reply with EDNS0 is %d bytes, over %d", n, dnsUDPSize)
+	}
+	if len(txtOf(edns)) <= len(txtOf(plain)) {
+		t.Errorf("EDNS0 answer (%d bytes) no longer than the plain one (%d)", len(txtOf(edns)), len(txtOf(plain)))
+	}
+}
+
+func TestDNSDeadline(t *testing.T) {
+	if testing.Short() {
+		t.Skip("waits out the DNS deadline")
+	}
+	exited := make(chan struct{})
+	stubLLM(t, func(ctx context.Context, input interface{}, stream chan<- string) (string, error) {
+		defer close(exited)
+		return slowReply(dnsDeadline+200*time.Millisecond, "too late")(ctx, input, stream)
+	})
+	// The rest of the answer is kept for continuations; let it finish first
+	t.Cleanup(func() { <-exited })
+
+	start := time.Now()
+	reply := askDNS(t, "udp", dnsQuery("slow-question.ch.at", dns.TypeTXT, 0))
+	if elapsed := time.Since(start); elapsed > dnsDeadline+500*time.Millisecond {
+		t.Errorf("answered after %s, past the %s deadline", elapsed, dnsDeadline)
+	}
+	if got := txtOf(reply); strings.Contains(got, "too late") || got == "" {
+		t.Errorf("answer %q, want a placeholder sent at the deadline", got)
+	}
+}
+
+func TestDNSDeadlineStopsBackend(t *testing.T) {
+	if testing.Short() {
+		t.Skip("waits out the DNS deadline")
+	}
+	// With nowhere to keep the rest of the answer, nothing may outlive the reply
+	useContinuations(t, keepNothing{})
+
+	exited := make(chan struct{})
+	stubLLM(t, func(ctx context.Context, input interface{}, stream chan<- string) (string, error) {
+		defer close(exited)
+		defer close(stream)
+		if deadline, ok := ctx.Deadline(); !ok || time.Until(deadline) > dnsGenerateTimeout {
+			t.Errorf("backend deadline %v (set %v), want one within %s", deadline, ok, dnsGenerateTimeout)
+		}
+		<-ctx.Done() // A backend that never answers
+		return "", ctx.Err()
+	})
+
+	askDNS(t, "udp", dnsQuery("never-answered.ch.at", dns.TypeTXT, 0))
+	select {
+	case <-exited:
+	case <-time.After(time.Second):
+		t.Error("backend still running after the deadline reply")
+	}
+}
+
+func TestDNSMessageSize(t *testing.T) {
+	for _, tt := range []struct {
+		network string
+		edns    uint16
+		want    int
+	}{
+		{"udp", 0, dns.MinMsgSize},
+		{"udp", 256, dns.MinMsgSize},
+		{"udp", 1000, 1000},
+		{"udp", 4096, dnsUDPSize},
+		{"tcp", 0, dns.MaxMsgSize},
+		{"tcp", 1000, dns.MaxMsgSize},
+	} {
+		got := dnsMessageSize(newDNSRecorder(tt.network), dnsQuery("x.ch.at", dns.TypeTXT, tt.edns))
+		if got != tt.want {
+			t.Errorf("%s with EDNS0 buffer %d: size %d, want %d", tt.network, tt.edns, got, tt.want)
+		}
+	}
+}
+
+func TestDNSAdvertisesEDNS0(t *testing.T) {
+	stubLLM(t, replyWith("ok"))
+
+	reply := askDNS(t, "udp", dnsQuery("hi.ch.at", dns.TypeTXT, 4096))
+	if opt := reply.IsEdns0(); opt == nil || opt.UDPSize() != dnsUDPSize {
+		t.Errorf("OPT record %v, want one advertising %d bytes", opt, dnsUDPSize)
+	}
+	if reply := askDNS(t, "udp", dnsQuery("hi.ch.at", dns.TypeTXT, 0)); reply.IsEdns0() != nil {
+		t.Error("OPT record sent to a client that didn't use EDNS0")
+	}
+}
+
+func TestDNSNoRoomSetsTC(t *testing.T) {
+	refuseLLM(t)
+	// A name this long leaves a 512-byte reply no room worth answering in
+	name := strings.TrimSuffix(strings.Repeat(strings.Repeat("a", 60)+".", 4), ".") + ".ch.at"
+	m := new(dns.Msg)
+	m.SetQuestion(dns.Fqdn(name), dns.TypeTXT)
+	if limit := dnsAnswerLimit(m, dns.MinMsgSize); limit >= dnsMinAnswer {
+		t.Fatalf("limit %d for a %d-byte name; the test needs a longer one", limit, len(name))
+	}
+
+	reply := askDNS(t, "udp", dnsQuery(name, dns.TypeTXT, 0))
+	if !reply.Truncated || len(reply.Answer) != 0 {
+		t.Errorf("TC %v with %d answers, want TC and none", reply.Truncated, len(reply.Answer))
+	}
+	if reply.Len() > dns.MinMsgSize {
+		t.Errorf("reply is %d bytes", reply.Len())
+	}
+
+	// Retried over TCP, as TC asks, it gets an answer
+	if reply := askDNS(t, "tcp", dnsQuery(name, dns.TypeTXT, 0)); reply.Truncated || txtOf(reply) == "" {
+		t.Errorf("over TCP: TC %v, answer %q", reply.Truncated, txtOf(reply))
+	}
+}
+
+// b32Name encodes question as base32 labels of at most 63 bytes
+func b32Name(question string) string {
+	encoded := strings.ToLower(dnsBase32.EncodeToString([]byte(question)))
+	var labels []string
+	for len(encoded) > 0 {
+		n := min(len(encoded), 63-len(dnsBase32Prefix))
+		labels = append(labels, encoded[:n])
+		encoded = encoded[n:]
+	}
+	return dnsBase32Prefix + strings.Join(labels, ".")
+}
+
+func TestDNSQueryTextBase32(t *testing.T) {
+	for _, question := range []string{
+		"What's 2+2? (Show work, please!)",
+		"¿Dónde está la biblioteca? 图书馆在哪里？",
+		`"quotes", semi;colons & <angles> \ back\slash`,
+		strings.Repeat("long question with, punctuation. ", 5),
+	} {
+		name := b32Name(question)
+		got, err := dnsQueryText(name)
+		if err != nil || got != question {
+			t.Errorf("dnsQueryText(%q) = %q, %v; want %q", name, got, err, question)
+		}
+		// Resolvers may change case
+		if got, err := dnsQueryText(strings.ToUpper(name)); err != nil || got != question {
+			t.Errorf("uppercased: got %q, %v", got, err)
+		}
+	}
+}
+
+func TestDNSQueryTextPlain(t *testing.T) {
+	if got, err := dnsQueryText("what-is-dns"); err != nil || got != "what is dns" {
+		t.Errorf("dnsQueryText = %q, %v; want dashes as spaces", got, err)
+	}
+	for _, name := range []string{"b32-!!!", "b32-" + strings.ToLower(dnsBase32.EncodeToString([]byte{0xff, 0xfe}))} {
+		if _, err := dnsQueryText(name); err == nil {
+			t.Errorf("dnsQueryText(%q) accepted bad base32 or UTF-8", name)
+		}
+	}
+}
+
+func TestDNSEmptyQuery(t *testing.T) {
+	refuseLLM(t)
+	for _, name := range []string{"b32-", "B32-", b32Name("   "), b32Name("\n\t"), "--"} {
+		if _, err := dnsQueryText(name); err == nil || err.Error() != "empty query" {
+			t.Errorf("dnsQueryText(%q) = %v, want empty query", name, err)
+		}
+		if got := txtOf(askDNS(t, "udp", dnsQuery(name+".ch.at", dns.TypeTXT, 0))); got != "empty query" {
+			t.Errorf("%s: answer %q, want empty query", name, got)
+		}
+	}
+}
+
+func TestDNSBase32Question(t *testing.T) {
+	question := "What's 2+2? (Show work!)"
+	prompts := make(chan string, 1)
+	stubLLM(t, func(ctx context.Context, input interface{}, stream chan<- string) (string, error) {
+		prompts <- promptOf(input)
+		return replyWith("4")(ctx, input, stream)
+	})
+	askDNS(t, "udp", dnsQuery(b32Name(question)+".ch.at", dns.TypeTXT, 0))
+	if prompt := <-prompts; !strings.HasSuffix(prompt, question) {
+		t.Errorf("backend asked %q, want it to end with the decoded question", prompt)
+	}
+}
+
+func TestDNSRawQuestion(t *testing.T) {
+	useCache(t, 0)
+	prompts := make(chan string, 1)
+	stubLLM(t, func(ctx context.Context, input interface{}, stream chan<- string) (string, error) {
+		prompts <- promptOf(input)
+		return replyWith("4")(ctx, input, stream)
+	})
+	askDNS(t, "udp", dnsQuery("what-is-2-plus-2.raw.ch.at", dns.TypeTXT, 0))
+	if prompt := <-prompts; prompt != "what is 2 plus 2" {
+		t.Errorf("raw: backend asked %q, want the question alone", prompt)
+	}
+	askDNS(t, "udp", dnsQuery("what-is-2-plus-2.ch.at", dns.TypeTXT, 0))
+	if prompt := <-prompts; prompt == "what is 2 plus 2" {
+		t.Error("without .raw: backend got the question without instructions")
+	}
+}
+
+// morePointer matches the pointer ending a page of a long answer
+var morePointer = regexp.MustCompile(`\.\.\. \(more: ([0-9a-f]+-\d+)\.more\.ch\.at\)$`)
+
+func TestDNSContinuationReadsWholeAnswer(t *testing.T) {
+	var chunks []string
+	for i := 0; i < 40; i++ {
+		chunks = append(chunks, fmt.Sprintf("Sentence number %d of a long answer. ", i))
+	}
+	stubLLM(t, replyWith(chunks...))
+
+	var got strings.Builder
+	name := "tell-me-a-story.ch.at"
+	for pages := 1; ; pages++ {
+		if pages > 20 {
+			t.Fatalf("still paging after %d pages", pages)
+		}
+		page := txtOf(askDNS(t, "udp", dnsQuery(name, dns.TypeTXT, 0)))
+		m := morePointer.FindStringSubmatch(page)
+		if m == nil {
+			got.WriteString(page)
+			if pages == 1 {
+				t.Fatal("long answer fit in one page; the test needs a longer one")
+			}
+			break
+		}
+		got.WriteString(page[:len(page)-len(m[0])])
+		name = m[1] + ".more.ch.at"
+	}
+	if want := strings.Join(chunks, ""); got.String() != want {
+		t.Errorf("pages add up to %q, want %q", got.String(), want)
+	}
+}
+
+// useContinuations gives the rest of the test its own continuation store
+func useContinuations(t *testing.T, s Store) {
+	t.Helper()
+	old := dnsContinuations
+	dnsContinuations = s
+	t.Cleanup(func() { dnsContinuations = old })
+}
+
+// noError is the error channel of a stream that ends normally
+func noError() <-chan error {
+	errc := make(chan error, 1)
+	errc <- nil
+	return errc
+}
+
+// keepNothing is a Store that drops everything it is given
+type keepNothing struct{}
+
+func (keepNothing) Get(string) (any, bool)         { return nil, false }
+func (keepNothing) Set(string, any, time.Duration) {}
+func (keepNothing) Delete(string)                  {}
+
+func TestDNSContinueStoredAnswer(t *testing.T) {
+	useContinuations(t, newMemoryStore(dnsMaxContinuations))
+	ch := make(chan string)
+	finished := make(chan struct{})
+	id := storeContinuation("first part, ", ch, noError(), func() { close(finished) })
+	if id == "" {
+		t.Fatal("store full")
+	}
+	ch <- "second part."
+	close(ch)
+	<-finished
+
+	if got := strings.Join(dnsContinue("x.", id+"-0", 400).Txt, ""); got != "first part, second part." {
+		t.Errorf("from the start: %q", got)
+	}
+	if got := strings.Join(dnsContinue("x.", id+"-12", 400).Txt, ""); got != "second part." {
+		t.Errorf("from offset 12: %q", got)
+	}
+	for _, token := range []string{id + "-999", id + "-x", id + "--1", "deadbeef-0"} {
+		if got := strings.Join(dnsContinue("x.", token, 400).Txt, ""); got != "Unknown or expired continuation" {
+			t.Errorf("%s: %q", token, got)
+		}
+	}
+}
+
+func TestDNSContinuationCutShort(t *testing.T) {
+	useContinuations(t, newMemoryStore(dnsMaxContinuations))
+	for _, tt := range []struct {
+		err  error
+		last string
+	}{
+		{context.DeadlineExceeded, "Request timed out"},
+		{errors.New("connection reset"), "Error: the model backend failed, try again later"},
+	} {
+		ch := make(chan string)
+		errc := make(chan error, 1)
+		finished := make(chan struct{})
+		id := storeContinuation("first part, ", ch, errc, func() { close(finished) })
+		ch <- "second part"
+		close(ch)
+		errc <- tt.err
+		<-finished
+
+		txt := dnsContinue("x.", id+"-0", 400)
+		if got := strings.Join(txt.Txt, ""); got != "first part, second part... (incomplete)" {
+			t.Errorf("%v: from the start: %q", tt.err, got)
+		}
+		if txt.Hdr.Ttl != 0 {
+			t.Errorf("%v: TTL %d on a cut-short answer, want 0", tt.err, txt.Hdr.Ttl)
+		}
+		if got := strings.Join(dnsContinue("x.", id+"-23", 400).Txt, ""); got != tt.last {
+			t.Errorf("%v: past the end: %q, want %q", tt.err, got, tt.last)
+		}
+	}
+}
+
+func TestDNSContinuationExpires(t *testing.T) {
+	useContinuations(t, newMemoryStore(dnsMaxContinuations))
+	ch := make(chan string)
+	close(ch)
+	id := storeContinuation("an old answer", ch, noError(), func() {})
+
+	c, _ := dnsContinuations.Get(id)
+	dnsContinuations.Set(id, c, -time.Second)
+	if got := strings.Join(dnsContinue("x.", id+"-0", 400).Txt, ""); got != "Unknown or expired continuation" {
+		t.Errorf("expired continuation answered %q", got)
+	}
+}
+
+func TestDNSContinuationsEvictOldest(t *testing.T) {
+	useContinuations(t, newMemoryStore(2))
+	ch := make(chan string)
+	close(ch)
+
+	var ids []string
+	for _, answer := range []string{"first", "second", "third"} {
+		id := storeContinuation(answer, ch, noError(), func() {})
+		if id == "" {
+			t.Fatalf("%s answer not kept", answer)
+		}
+		ids = append(ids, id)
+		time.Sleep(time.Millisecond) // Distinct expiry times
+	}
+	if got := strings.Join(dnsContinue("x.", ids[0]+"-0", 400).Txt, ""); got != "Unknown or expired continuation" {
+		t.Errorf("oldest continuation answered %q after eviction", got)
+	}
+	if got := strings.Join(dnsContinue("x.", ids[2]+"-0", 400).Txt, ""); got != "third" {
+		t.Errorf("newest continuation answered %q", got)
+	}
+}
+
+// ttlOf is the TTL of the first answer in m
+func ttlOf(t *testing.T, m *dns.Msg) uint32 {
+	t.Helper()
+	if len(m.Answer) == 0 {
+		t.Fatal("no answer")
+	}
+	return m.Answer[0].Header().Ttl
+}
+
+func TestDNSRecordTTL(t *testing.T) {
+	stubLLM(t, replyWith("pass"))
+	if got := ttlOf(t, askDNS(t, "udp", dnsQuery("repeat-pass.ch.at", dns.TypeTXT, 0))); got != dnsTTL {
+		t.Errorf("TTL %d, want the configured %d", got, dnsTTL)
+	}
+
+	stubLLM(t, failWith(errors.New("upstream down")))
+	if got := ttlOf(t, askDNS(t, "udp", dnsQuery("repeat-pass-again.ch.at", dns.TypeTXT, 0))); got != 0 {
+		t.Errorf("TTL %d on a failure, want 0", got)
+	}
+}
+
+func TestDNSTTLFollowsCache(t *testing.T) {
+	useCache(t, 30*time.Second)
+	if got := dnsRecordTTL(); got != min(dnsTTL, 30) {
+		t.Errorf("dnsRecordTTL = %d with a 30s cache", got)
+	}
+
+	stubLLM(t, replyWith("pass"))
+	askDNS(t, "udp", dnsQuery("repeat-pass.ch.at", dns.TypeTXT, 0))
+	// Age the cached answer so only 10s of it are left
+	store := llmCache.entries.(*memoryStore)
+	store.mu.Lock()
+	for key, entry := range store.entries {
+		answer := entry.value.(cachedAnswer)
+		answer.expires = time.Now().Add(10*time.Second + 500*time.Millisecond)
+		store.entries[key] = storeEntry{value: answer, expires: answer.expires}
+	}
+	store.mu.Unlock()
+
+	if got := ttlOf(t, askDNS(t, "udp", dnsQuery("repeat-pass.ch.at", dns.TypeTXT, 0))); got != 10 {
+		t.Errorf("TTL %d for an answer cached for 10 more seconds, want 10", got)
+	}
+}
+
+func TestDNSCapTTL(t *testing.T) {
+	for _, tt := range []struct {
+		expires time.Time
+		want    uint32
+	}{
+		{time.Time{}, 60},
+		{time.Now().Add(time.Hour), 60},
+		{time.Now().Add(5500 * time.Millisecond), 5},
+		{time.Now().Add(-time.Second), 0},
+	} {
+		txt := &dns.TXT{Hdr: dns.RR_Header{Ttl: 60}}
+		dnsCapTTL(txt, tt.expires)
+		if txt.Hdr.Ttl != tt.want {
+			t.Errorf("expiring in %s: TTL %d, want %d", time.Until(tt.expires).Round(time.Second), txt.Hdr.Ttl, tt.want)
+		}
+	}
+}
+
+func TestDNSPingAnswer(t *testing.T) {
+	ping := func(name string, qtype uint16) dns.Question {
+		return dns.Question{Name: dns.Fqdn(name), Qtype: qtype, Qclass: dns.ClassINET}
+	}
+	a := dnsPingAnswer(ping("PING.ch.at", dns.TypeA), "ping.ch.at", "127.0.0.1")
+	if a == nil || !a.A.Equal(net.IPv4(127, 0, 0, 1)) || a.Hdr.Name != "PING.ch.at." || a.Hdr.Ttl != 0 {
+		t.Errorf("ping query answered with %v", a)
+	}
+	for _, tt := range []struct {
+		q    dns.Question
+		name string
+	}{
+		{ping("ping.ch.at", dns.TypeTXT), "ping.ch.at"},
+		{ping("other.ch.at", dns.TypeA), "ping.ch.at"},
+		{ping("ping.ch.at", dns.TypeA), ""},
+	} {
+		if a := dnsPingAnswer(tt.q, tt.name, "127.0.0.1"); a != nil {
+			t.Errorf("%s %s with ping name %q answered with %v", dns.TypeToString[tt.q.Qtype], tt.q.Name, tt.name, a)
+		}
+	}
+
+	// Whether or not the check is on, A queries never reach the model
+	refuseLLM(t)
+	askDNS(t, "udp", dnsQuery("ping.ch.at", dns.TypeA, 0))
+}
+
+func TestDNSRefusesSeveralQuestions(t *testing.T) {
+	refuseLLM(t)
+	r := dnsQuery("first-question.ch.at", dns.TypeTXT, 0)
+	r.Question = append(r.Question, dns.Question{Name: "second-question.ch.at.", Qtype: dns.TypeTXT, Qclass: dns.ClassINET})
+
+	reply := askDNS(t, "udp", r)
+	if reply.Rcode != dns.RcodeRefused || len(reply.Answer) != 0 {
+		t.Errorf("rcode %s with %d answers, want REFUSED and none", dns.RcodeToString[reply.Rcode], len(reply.Answer))
+	}
+}
+
+func TestDNSIgnoresEmptyQuestion(t *testing.T) {
+	w := newDNSRecorder("udp")
+	handleDNS(w, new(dns.Msg))
+	if w.reply != nil {
+		t.Errorf("replied to a message without a question: %v", w.reply)
+	}
+}
+
+func TestDNSErrorText(t *testing.T) {
+	for err, want := range map[error]string{
+		errServerBusy:                         "Server busy, try again later",
+		fmt.Errorf("x: %w", errNotConfigured): "Service not configured, try again later",
+		context.DeadlineExceeded:              "Request timed out",
+		errors.New("upstream status 500"):     "Error: the model backend failed, try again later",
+	} {
+		if got := dnsErrorText(err); got != want {
+			t.Errorf("dnsErrorText(%v) = %q, want %q", err, got, want)
+		}
+	}
+}
+
+func TestDNSBackendErrorAnsweredAtOnce(t *testing.T) {
+	stubLLM(t, failWith(errServerBusy))
+	start := time.Now()
+	reply := askDNS(t, "udp", dnsQuery("busy-question.ch.at", dns.TypeTXT, 0))
+	if elapsed := time.Since(start); elapsed > dnsDeadline/2 {
+		t.Errorf("error reported after %s, as if it had timed out", elapsed)
+	}
+	if got := txtOf(reply); got != "Server busy, try again later" {
+		t.Errorf("answer %q, want the backend's error", got)
+	}
+	if ttl := ttlOf(t, reply); ttl != 0 {
+		t.Errorf("TTL %d on an error, want 0", ttl)
+	}
+}
+
+func TestDNSBackendErrorAfterPartialAnswer(t *testing.T) {
+	stubLLM(t, failWith(errors.New("connection reset"), "The answer is"))
+	reply := askDNS(t, "udp", dnsQuery("cut-question.ch.at", dns.TypeTXT, 0))
+	if got := txtOf(reply); got != "The answer is... (incomplete)" {
+		t.Errorf("answer %q, want the partial answer marked incomplete", got)
+	}
+}
+
+func TestDNSBackendErrorAfterFirstPage(t *testing.T) {
+	useContinuations(t, newMemoryStore(dnsMaxContinuations))
+	long := strings.Repeat("A sentence of a long answer. ", 30)
+	stubLLM(t, failWith(errors.New("connection reset"), long))
+
+	name := "fail-later.ch.at"
+	for pages := 1; ; pages++ {
+		if pages > 10 {
+			t.Fatalf("still paging after %d pages", pages)
+		}
+		reply := askDNS(t, "udp", dnsQuery(name, dns.TypeTXT, 0))
+		page := txtOf(reply)
+		m := morePointer.FindStringSubmatch(page)
+		if m == nil {
+			if pages == 1 {
+				t.Fatal("answer fit in one page; the test needs a longer one")
+			}
+			if !strings.HasSuffix(page, "... (incomplete)") {
+				t.Errorf("last page %q, want it marked incomplete", page)
+			}
+			if ttl := ttlOf(t, reply); ttl != 0 {
+				t.Errorf("TTL %d on the cut-short last page, want 0", ttl)
+			}
+			break
+		}
+		name = m[1] + ".more.ch.at"
+	}
+}
+
+func TestDNSSlowAnswerWithinDeadline(t *testing.T) {
+	stubLLM(t, slowReply(dnsDeadline/20, "slow ", "but ", "in time"))
+	if got := txtOf(askDNS(t, "udp", dnsQuery("slow-question.ch.at", dns.TypeTXT, 0))); got != "slow but in time" {
+		t.Errorf("answer %q, want the whole slow answer", got)
+	}
+}
+
+func TestDNSUnconfiguredBackend(t *testing.T) {
+	refuseLLM(t)
+	notReady(t)
+	reply := askDNS(t, "udp", dnsQuery("hi.ch.at", dns.TypeTXT, 0))
+	if got := txtOf(reply); got != "Service not configured, try again later" {
+		t.Errorf("answer %q", got)
+	}
+	if ttl := ttlOf(t, reply); ttl != 0 {
+		t.Errorf("TTL %d, want 0 so resolvers ask again once it is configured", ttl)
+	}
+}
+
+func TestDNSCut(t *testing.T) {
+	for _, tt := range []struct {
+		text string
+		n    int
+		want string
+	}{
+		{"hello", 0, ""},
+		{"hello", -1, ""},
+		{"hello", 5, "hello"},
+		{"hello", 10, "hello"},
+		{"One two. Three four", 10, "One two."},             // Sentence end
+		{"one two three four", 10, "one two"},               // Word
+		{"Hi. and then some more", 20, "Hi. and then some"}, // Sentence too far back
+		{"abcdefgh", 4, "abcd"},                             // No space at all
+		{"ééé", 3, "é"},                                     // Inside a rune
+		{"ab ééé", 5, "ab"},
+	} {
+		if got := tt.text[:dnsCut(tt.text, tt.n)]; got != tt.want {
+			t.Errorf("dnsCut(%q, %d) keeps %q, want %q", tt.text, tt.n, got, tt.want)
+		}
+	}
+}
+
+func TestDNSPage(t *testing.T) {
+	const id = "0123abcd"
+	long := strings.Repeat("Words in a sentence. ", 20)
+
+	if got := dnsPage(id, "short answer", 0, true, nil, 100); got != "short answer" {
+		t.Errorf("complete answer that fits: %q", got)
+	}
+	if got := dnsPage(id, "", 0, false, nil, 100); !strings.HasPrefix(got, "Still thinking") {
+		t.Errorf("nothing yet: %q", got)
+	}
+	// No room for a pointer: send it all and let the reply be truncated
+	if got := dnsPage(id, long, 0, false, nil, dnsMoreReserve); got != long {
+		t.Errorf("limit %d: %q, want all of it", dnsMoreReserve, got)
+	}
+
+	for _, text := range []string{long, strings.Repeat("漢字", 100)} {
+		for _, limit := range []int{dnsMoreReserve + utf8.UTFMax, 100, 255} {
+			page := dnsPage(id, text, 0, true, nil, limit)
+			body, more, ok := strings.Cut(page, "... (more: "+id+"-")
+			if !ok || len(page) > limit || !utf8.ValidString(body) {
+				t.Errorf("limit %d: page %q", limit, page)
+				continue
+			}
+			if want := fmt.Sprintf("%d.more.ch.at)", len(body)); more != want {
+				t.Errorf("limit %d: pointer %q, want %q", limit, more, want)
+			}
+		}
+	}
+}
+
+func TestDNSLongNameWithoutEDNS0(t *testing.T) {
+	stubLLM(t, replyWith(strings.Repeat("an answer ", 100)))
+	// The longest name DNS allows, in a query with no EDNS0 buffer
+	name := strings.Repeat(strings.Repeat("a", 62)+".", 3) + strings.Repeat("a", 58) + ".ch.at"
+	if len(name) != 253 {
+		t.Fatalf("name is %d bytes", len(name))
+	}
+	reply := askDNS(t, "udp", dnsQuery(name, dns.TypeTXT, 0))
+	if reply.Len() > dns.MinMsgSize {
+		t.Errorf("reply is %d bytes", reply.Len())
+	}
+	if !reply.Truncated && txtOf(reply) == "" {
+		t.Error("neither TC nor an answer")
+	}
+}
+
+func TestDNSPromptLengthLimit(t *testing.T) {
+	// Plain names keep their dots, so 4 labels of 50 come to 203 bytes
+	label := strings.Repeat("a", 50)
+	name := strings.Join([]string{label, label, label, label}, ".") + ".ch.at"
+
+	refuseLLM(t)
+	want := fmt.Sprintf("Question too long: the limit is %d bytes", dnsMaxPrompt)
+	if got := txtOf(askDNS(t, "tcp", dnsQuery(name, dns.TypeTXT, 0))); got != want {
+		t.Errorf("question over the limit: %q", got)
+	}
+
+	stubLLM(t, replyWith("ok"))
+	name = strings.Join([]string{label, label, label, label[3:]}, ".") + ".ch.at"
+	if got := txtOf(askDNS(t, "tcp", dnsQuery(name, dns.TypeTXT, 0))); got != "ok" {
+		t.Errorf("question at the limit: %q", got)
+	}
+}
+
+func TestDNSConcurrencyBounded(t *testing.T) {
+	old := dnsSlots
+	dnsSlots = make(chan struct{}, 2)
+	t.Cleanup(func() { dnsSlots = old })
+
+	started := make(chan struct{}, 3)
+	release := make(chan struct{})
+	stubLLM(t, func(ctx context.Context, input interface{}, stream chan<- string) (string, error) {
+		started <- struct{}{}
+		<-release
+		return replyWith("ok")(ctx, input, stream)
+	})
+
+	replies := make(chan *dns.Msg, 2)
+	for i := range 2 {
+		go func() {
+			w := newDNSRecorder("udp")
+			handleDNS(w, dnsQuery(fmt.Sprintf("busy-%d.ch.at", i), dns.TypeTXT, 0))
+			replies <- w.reply
+		}()
+	}
+	<-started
+	<-started
+
+	// Both slots are taken: the next query is turned away without a call
+	if reply := askDNS(t, "udp", dnsQuery("one-more.ch.at", dns.TypeTXT, 0)); reply.Rcode != dns.RcodeServerFailure {
+		t.Errorf("query over the limit: rcode %s, want SERVFAIL", dns.RcodeToString[reply.Rcode])
+	}
+
+	close(release)
+	for range 2 {
+		if reply := <-replies; reply == nil || txtOf(reply) != "ok" {
+			t.Errorf("query within the limit: %v", reply)
+		}
+	}
+	if n := len(dnsSlots); n != 0 {
+		t.Errorf("%d slots still held after the answers", n)
+	}
+	if reply := askDNS(t, "udp", dnsQuery("after.ch.at", dns.TypeTXT, 0)); txtOf(reply) != "ok" {
+		t.Errorf("query after the load: %q", txtOf(reply))
+	}
+}
+
+func TestDNSContinuationFreesQuerySlot(t *testing.T) {
+	useContinuations(t, newMemoryStore(dnsMaxContinuations))
+	oldSlots, oldGenerating := dnsSlots, dnsGenerating
+	dnsSlots, dnsGenerating = make(chan struct{}, 1), make(chan struct{}, 1)
+	t.Cleanup(func() { dnsSlots, dnsGenerating = oldSlots, oldGenerating })
+
+	// A long first page, then a model that keeps writing until told to stop
+	long := strings.Repeat("A sentence of a long answer. ", 30)
+	finish := make(chan struct{})
+	stubLLM(t, func(ctx context.Context, input interface{}, stream chan<- string) (string, error) {
+		defer close(stream)
+		if !strings.Contains(promptOf(input), "long") {
+			stream <- "short"
+			return "", nil
+		}
+		stream <- long
+		select {
+		case <-finish:
+			return "", nil
+		case <-ctx.Done():
+			return "", ctx.Err()
+		}
+	})
+
+	if page := txtOf(askDNS(t, "udp", dnsQuery("a-long-one.ch.at", dns.TypeTXT, 0))); !morePointer.MatchString(page) {
+		t.Fatalf("first page %q has no continuation", page)
+	}
+	if n := len(dnsSlots); n != 0 {
+		t.Errorf("%d query slots held while the answer is still being written, want 0", n)
+	}
+	if reply := askDNS(t, "udp", dnsQuery("next-question.ch.at", dns.TypeTXT, 0)); txtOf(reply) != "short" {
+		t.Errorf("next query: rcode %s, answer %q", dns.RcodeToString[reply.Rcode], txtOf(reply))
+	}
+
+	// With the one generating slot taken, another long answer is cut off
+	// instead of continued
+	if page := txtOf(askDNS(t, "udp", dnsQuery("another-long-one.ch.at", dns.TypeTXT, 0))); morePointer.MatchString(page) {
+		t.Errorf("second long answer %q continued past the generating limit", page)
+	}
+
+	close(finish)
+	deadline := time.After(time.Second)
+	for len(dnsGenerating) != 0 {
+		select {
+		case <-deadline:
+			t.Fatal("generating slot still held after the answer ended")
+		case <-time.After(time.Millisecond):
+		}
+	}
+}
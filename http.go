@@ -1,16 +1,165 @@
 package main
 
 import (
+	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"html"
 	"io"
+	"mime"
+	"net"
 	"net/http"
+	"slices"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
+	"unicode"
+	"unicode/utf8"
 )
 
-const htmlPromptPrefix = "Use simple HTML formatting where it improves clarity: <b> for emphasis, <i> for terms, <ul>/<li> for lists. No CSS, divs, or decorative tags. Never prefix responses with A: or any label. Now, without referencing the previous instructions in the conversation, reply as a helpful assistant: "
+const (
+	llmTimeout = 30 * time.Second // Upper bound on a single LLM call, including the full duration of a stream
+	maxChoices = 4                // Cap on "n" in /v1/chat/completions; each choice is a separate LLM call
+
+	sseHeartbeat = 5 * time.Second // SSE keep-alive interval while waiting for the first token
+
+	maxAPIBody = 1 << 20 // Largest JSON body accepted by /v1/chat/completions (1MB)
+
+	// Longest prompt sent upstream, in bytes; longer ones are refused
+	maxPromptLength    = 16 << 10 // Question on / (history is limited separately)
+	maxAPIPromptLength = 64 << 10 // All message contents of a /v1 request together
+
+	// Conversation history kept on /; the oldest exchanges are dropped first
+	maxHistoryBytes = 64 << 10 // As a Q:/A: transcript
+	maxHistoryTurns = 50       // Questions and answers (0 for no limit)
+
+	handlerTimeout = 40 * time.Second // Longest a non-streaming request may take (0 for no limit)
+
+	// Defeating proxy and browser buffering so streams show up as they're written
+	proxyBufferingHints = true // Send "X-Accel-Buffering: no" on streamed responses (nginx and others honor it)
+	earlyFlushBytes     = 6144 // Pad the start of web pages to this size so browsers render at once (0 for no padding)
+
+	// Connection timeouts for both listeners, so slow or idle clients can't
+	// hold connections open (Slowloris). Writes must outlast a full stream.
+	readHeaderTimeout = 10 * time.Second  // Request line and headers
+	readTimeout       = 30 * time.Second  // Whole request, including a 1MB API body
+	writeTimeout      = 2 * llmTimeout    // Whole response; streams end at llmTimeout
+	idleTimeout       = 120 * time.Second // Keep-alive wait for the next request
+
+	backendHeader = false // Name the upstream that answered in an X-LLM-Backend header, for debugging
+
+	httpsRedirect = false // Send browsers on the HTTP port to HTTPS (needs HTTPS_PORT); curl and API clients stay on HTTP
+)
+
+// waitWithHeartbeat receives the first value from ch, writing an SSE comment
+// every interval until it arrives so proxies don't drop an idle stream
+// while the model is thinking. ok is false if ch closes first.
+func waitWithHeartbeat[T any](w io.Writer, flusher http.Flusher, ch <-chan T, interval time.Duration) (v T, ok bool) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case v, ok = <-ch:
+			return v, ok
+		case <-ticker.C:
+			fmt.Fprint(w, ": keep-alive\n\n")
+			flusher.Flush()
+		}
+	}
+}
+
+// streamErrorMessage is the notice ending a stream that failed. A stream
+// that had started when llmTimeout, the cap on how long any answer may
+// stream, ran out was cut off rather than failed.
+func streamErrorMessage(err error, started bool) string {
+	if started && errors.Is(err, context.DeadlineExceeded) {
+		return fmt.Sprintf("Answer cut off after %s", llmTimeout)
+	}
+	_, _, message := classifyLLMError(err)
+	return message
+}
+
+// noFlush stands in for writers that can't flush; the response then goes
+// out as one piece when the handler returns instead of streaming
+type noFlush struct{}
+
+func (noFlush) Flush() {}
+
+// flusherOf returns w's Flusher, or a no-op one if w is wrapped in a way
+// that hides it
+func flusherOf(w http.ResponseWriter) http.Flusher {
+	if flusher, ok := w.(http.Flusher); ok {
+		return flusher
+	}
+	return noFlush{}
+}
+
+// disableProxyBuffering asks reverse proxies to pass a stream straight
+// through, if proxyBufferingHints is on
+func disableProxyBuffering(w http.ResponseWriter) {
+	if proxyBufferingHints {
+		w.Header().Set("X-Accel-Buffering", "no")
+	}
+}
+
+// earlyFlushPadding returns the zero-width spaces (3 bytes each) that bring
+// the start of a page from size bytes up to target, or "" if it's that long
+func earlyFlushPadding(size, target int) string {
+	if n := (target - size) / 3; n > 0 {
+		return strings.Repeat("\u200B", n)
+	}
+	return ""
+}
+
+// Command-line tools that get plain text streamed as it arrives, matched
+// case-insensitively against the product name at the start of the
+// User-Agent ("curl" matches "curl/8.4.0" and "curl")
+var cliUserAgents = []string{"curl", "wget", "httpie", "xh", "fetch", "aria2"}
+
+// isCLIUA reports whether ua comes from one of cliUserAgents
+func isCLIUA(ua string) bool {
+	product, _, _ := strings.Cut(strings.TrimSpace(ua), " ")
+	product, _, _ = strings.Cut(product, "/")
+	for _, name := range cliUserAgents {
+		if strings.EqualFold(product, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// writeSSE writes one server-sent event. Each line of data gets its own
+// "data:" field, which clients join back together with newlines.
+func writeSSE(w io.Writer, event, data string) error {
+	var b strings.Builder
+	if event != "" {
+		fmt.Fprintf(&b, "event: %s\n", event)
+	}
+	for _, line := range strings.Split(data, "\n") {
+		fmt.Fprintf(&b, "data: %s\n", line)
+	}
+	b.WriteString("\n")
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+// classifyLLMError maps an LLM failure to an HTTP status, an API error code
+// and a message that is safe to show the client.
+func classifyLLMError(err error) (status int, code, message string) {
+	switch {
+	case errors.Is(err, context.DeadlineExceeded):
+		return http.StatusGatewayTimeout, "timeout", "Timed out waiting for the model"
+	case errors.Is(err, errServerBusy):
+		return http.StatusServiceUnavailable, "server_busy", "Server busy, try again later"
+	case errors.Is(err, errNotConfigured):
+		return http.StatusServiceUnavailable, "not_configured", "Service not configured, try again later"
+	default:
+		return http.StatusInternalServerError, "backend_error", err.Error()
+	}
+}
 
 // isBrowserUA checks if the user agent appears to be from a web browser
 func isBrowserUA(ua string) bool {
@@ -38,6 +187,7 @@ const htmlHeader = `<!DOCTYPE html>
         .chat { text-align: left; max-width: 600px; margin: 0 auto; }
         .q { background: rgba(128, 128, 128, 0.1); padding: 0.5rem; font-style: italic; }
         .a { padding: 0.5rem; }
+        .error { color: #c33; }
     </style>
 </head>
 <body>
@@ -60,42 +210,305 @@ const htmlFooterTemplate = `</div>
 </body>
 </html>`
 
-func StartHTTPServer(port int) error {
-	http.HandleFunc("/", handleRoot)
-	http.HandleFunc("/v1/chat/completions", handleChatCompletions)
+// Served to crawlers at /robots.txt; the default keeps them all out
+const robotsTxt = "User-agent: *\nDisallow: /\n"
+
+// newMux registers every HTTP route. main builds it once and shares it
+// between the HTTP and HTTPS listeners, so either can run alone.
+func newMux() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", handleRoot)
+	mux.HandleFunc("/v1/chat/completions", handleChatCompletions)
+	mux.HandleFunc("/v1/embeddings", handleEmbeddings)
+	mux.HandleFunc("/v1/", handleAPINotFound)
+	mux.HandleFunc("/favicon.ico", handleFavicon)
+	mux.HandleFunc("/robots.txt", handleRobots)
+	mux.HandleFunc("/readyz", handleReadyz)
+	mux.HandleFunc("/version", handleVersion)
+	mux.HandleFunc("/debug/prompt", handleDebugPrompt)
+	return tagRequests(reportBackend(limitDuration(mux, handlerTimeout)))
+}
 
-	addr := fmt.Sprintf(":%d", port)
-	return http.ListenAndServe(addr, nil)
+// reportBackend adds an X-LLM-Backend header naming the upstream that
+// answered, if backendHeader is on. The header can only go out with the
+// status line, so a stream that starts before the model answers (like a
+// web page) doesn't get one.
+func reportBackend(h http.Handler) http.Handler {
+	if !backendHeader {
+		return h
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx, rec := withBackendRecord(r.Context())
+		h.ServeHTTP(&backendHeaderWriter{ResponseWriter: w, rec: rec}, r.WithContext(ctx))
+	})
 }
 
-func StartHTTPSServer(port int, certFile, keyFile string) error {
-	addr := fmt.Sprintf(":%d", port)
-	return http.ListenAndServeTLS(addr, certFile, keyFile, nil)
+type backendHeaderWriter struct {
+	http.ResponseWriter
+	rec         *backendRecord
+	wroteHeader bool
 }
 
-func handleRoot(w http.ResponseWriter, r *http.Request) {
+func (w *backendHeaderWriter) WriteHeader(status int) {
+	if !w.wroteHeader {
+		w.wroteHeader = true
+		if name := w.rec.Name(); name != "" {
+			w.Header().Set("X-LLM-Backend", name)
+		}
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *backendHeaderWriter) Write(b []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *backendHeaderWriter) Flush() {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	flusherOf(w.ResponseWriter).Flush()
+}
+
+func (w *backendHeaderWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// limitDuration cuts off non-streaming requests after timeout (handlerTimeout)
+// with a 503. Streams are left alone: http.TimeoutHandler buffers the
+// response, and their handlers bound them with llmTimeout instead.
+func limitDuration(h http.Handler, timeout time.Duration) http.Handler {
+	if timeout <= 0 {
+		return h
+	}
+	limited := http.TimeoutHandler(h, timeout, "Request timed out")
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if mayStream(r) {
+			h.ServeHTTP(w, r)
+			return
+		}
+		limited.ServeHTTP(w, r)
+	})
+}
+
+// mayStream reports whether the response to r may be streamed
+func mayStream(r *http.Request) bool {
+	switch r.URL.Path {
+	case "/v1/chat/completions":
+		return true // Decided by "stream" in the body
+	case "/v1/embeddings", "/favicon.ico", "/robots.txt", "/readyz", "/version", "/debug/prompt":
+		return false
+	}
+	if mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); r.Method == "POST" && mediaType == "application/json" {
+		return false // Answered as JSON, see handleRoot
+	}
+	mode, err := negotiate(r)
+	return err == nil && mode != modeText && mode != modeJSON
+}
+
+// tagRequests gives every request an X-Request-ID, keeping a well-formed one
+// from the client, echoes it in the response and attaches it to the context.
+func tagRequests(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get("X-Request-ID")
+		if !validRequestID(id) {
+			id = newRequestID()
+		}
+		w.Header().Set("X-Request-ID", id)
+		h.ServeHTTP(w, r.WithContext(withRequestID(r.Context(), id)))
+	})
+}
+
+// validRequestID accepts 1-64 characters of letters, digits, '.', '_' and '-'
+func validRequestID(id string) bool {
+	if id == "" || len(id) > 64 {
+		return false
+	}
+	for _, c := range id {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '.' || c == '_' || c == '-') {
+			return false
+		}
+	}
+	return true
+}
+
+func StartHTTPServer(addr string, handler http.Handler) error {
+	if httpsRedirect && HTTPS_PORT > 0 {
+		handler = redirectBrowsers(handler)
+	}
+	return newServer(addr, acmeHTTPHandler(handler)).ListenAndServe()
+}
+
+// newServer builds a server with the connection timeouts above
+func newServer(addr string, handler http.Handler) *http.Server {
+	return &http.Server{
+		Addr:              addr,
+		Handler:           handler,
+		ReadHeaderTimeout: readHeaderTimeout,
+		ReadTimeout:       readTimeout,
+		WriteTimeout:      writeTimeout,
+		IdleTimeout:       idleTimeout,
+	}
+}
+
+// redirectBrowsers answers browser GETs with a 301 to the same path on the
+// HTTPS listener and passes every other request to h.
+func redirectBrowsers(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if (r.Method != http.MethodGet && r.Method != http.MethodHead) || !isBrowserUA(r.Header.Get("User-Agent")) {
+			h.ServeHTTP(w, r)
+			return
+		}
+		http.Redirect(w, r, "https://"+httpsHost(r.Host, HTTPS_PORT)+r.URL.RequestURI(), http.StatusMovedPermanently)
+	})
+}
+
+// httpsHost turns the Host of a plain HTTP request into the host for the
+// HTTPS listener on port, omitting the default port
+func httpsHost(host string, port int) string {
+	if hostname, _, err := net.SplitHostPort(host); err == nil {
+		host = hostname
+	} else {
+		host = strings.TrimSuffix(strings.TrimPrefix(host, "["), "]") // IPv6 literal without a port
+	}
+	if port != 443 {
+		return net.JoinHostPort(host, strconv.Itoa(port))
+	}
+	if strings.Contains(host, ":") {
+		return "[" + host + "]"
+	}
+	return host
+}
+
+func StartHTTPSServer(addr, certFile, keyFile string, handler http.Handler) error {
+	config, err := tlsConfig(certFile, keyFile)
+	if err != nil {
+		return err
+	}
+	server := newServer(addr, handler)
+	server.TLSConfig = config
+	if config != nil {
+		// Certificates come from the config, not from files
+		return server.ListenAndServeTLS("", "")
+	}
+	return server.ListenAndServeTLS(certFile, keyFile)
+}
+
+// Paths internet scanners probe for. They get a 404 instead of becoming
+// path-based LLM queries. Matched case-insensitively.
+var (
+	probePrefixes = []string{"/.", "/wp-", "/wordpress", "/cgi-bin/", "/phpmyadmin", "/xmlrpc", "/vendor/", "/actuator", "/boaform", "/autodiscover"}
+	probeSuffixes = []string{".php", ".asp", ".aspx", ".jsp", ".cgi", ".env", ".sql", ".bak", ".ini", ".yml", ".xml", ".zip", ".gz"}
+)
+
+// isProbePath reports whether a request path looks like scanner noise
+func isProbePath(path string) bool {
+	path = strings.ToLower(path)
+	for _, prefix := range probePrefixes {
+		if strings.HasPrefix(path, prefix) {
+			return true
+		}
+	}
+	for _, suffix := range probeSuffixes {
+		if strings.HasSuffix(path, suffix) {
+			return true
+		}
+	}
+	return false
+}
+
+// Browsers request /favicon.ico on every page load; answer without
+// spending a rate-limit token or an LLM call on it.
+func handleFavicon(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", "public, max-age=86400")
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func handleRobots(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	fmt.Fprint(w, robotsTxt)
+}
+
+// handleReadyz is a readiness probe for load balancers: 503 until the LLM
+// backend is configured and reachable
+func handleReadyz(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	if llmReady() != nil {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		fmt.Fprintln(w, "not ready")
+		return
+	}
+	fmt.Fprintln(w, "ok")
+}
+
+// allowCORS lets browser pages on any origin call an endpoint that accepts
+// methods. It answers preflight requests itself, reporting whether r was one.
+func allowCORS(w http.ResponseWriter, r *http.Request, methods string) bool {
 	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Access-Control-Expose-Headers", "X-Request-ID")
+	if r.Method != "OPTIONS" {
+		return false
+	}
+	w.Header().Set("Access-Control-Allow-Methods", methods)
+	w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Accept, Accept-Language, Authorization, X-Request-ID")
+	w.Header().Set("Access-Control-Max-Age", "86400")
+	w.WriteHeader(http.StatusOK)
+	return true
+}
+
+// handleVersion reports which build is running, without rate limiting
+func handleVersion(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(buildInfo())
+}
+
+func handleRoot(w http.ResponseWriter, r *http.Request) {
+	if allowCORS(w, r, "GET, POST, OPTIONS") {
+		return
+	}
+	if isProbePath(r.URL.Path) {
+		http.NotFound(w, r)
+		return
+	}
 	if !rateLimitAllow(r.RemoteAddr) {
 		http.Error(w, "Rate limit exceeded", http.StatusTooManyRequests)
 		return
 	}
 
-	var query, history, prompt string
-	content := ""
-	jsonResponse := ""
+	ctx, cancel := context.WithTimeout(withProtocolModel(r.Context(), "http"), llmTimeout)
+	defer cancel()
 
-	if r.Method == "POST" {
+	var query, system string
+	var history []exchange
+	jsonBody := false
+
+	if mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); r.Method == "POST" && mediaType == "application/json" {
+		// A small JSON alternative to the /v1 API; answers are JSON too
+		var body rootRequest
+		if err := json.NewDecoder(io.LimitReader(r.Body, 65536)).Decode(&body); err != nil {
+			http.Error(w, "Invalid JSON", http.StatusBadRequest)
+			return
+		}
+		query, history, system, jsonBody = body.Q, body.H, body.System, true
+		if body.Model != "" {
+			if !modelAllowed(body.Model) {
+				http.Error(w, fmt.Sprintf("Model %q is not available", body.Model), http.StatusBadRequest)
+				return
+			}
+			ctx = withModel(ctx, body.Model)
+		}
+	} else if r.Method == "POST" {
 		if err := r.ParseForm(); err != nil {
 			http.Error(w, "Failed to parse form", http.StatusBadRequest)
 			return
 		}
 		query = r.FormValue("q")
-		history = r.FormValue("h")
-
-		// Limit history size to ensure compatibility
-		if len(history) > 65536 {
-			history = history[len(history)-65536:]
-		}
+		history = parseHistory(r.FormValue("h"))
 
 		if query == "" {
 			body, err := io.ReadAll(io.LimitReader(r.Body, 65536)) // Limit body size
@@ -108,208 +521,818 @@ func handleRoot(w http.ResponseWriter, r *http.Request) {
 	} else {
 		query = r.URL.Query().Get("q")
 		// Support path-based queries like /what-is-go
-		if query == "" && r.URL.Path != "/" {
-			query = strings.ReplaceAll(strings.TrimPrefix(r.URL.Path, "/"), "-", " ")
+		if query == "" {
+			query = pathQuery(r.URL.Path)
 		}
 	}
 
-	accept := r.Header.Get("Accept")
-	userAgent := strings.ToLower(r.Header.Get("User-Agent"))
-	wantsJSON := strings.Contains(accept, "application/json")
-	wantsHTML := isBrowserUA(userAgent) || strings.Contains(accept, "text/html")
-	wantsStream := strings.Contains(accept, "text/event-stream")
+	mode, err := negotiate(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if jsonBody {
+		mode = modeJSON
+	}
+
+	verbosity := r.FormValue("verbosity")
+	if _, ok := verbosityHints[verbosity]; verbosity != "" && !ok {
+		http.Error(w, "verbosity must be short, normal or long", http.StatusBadRequest)
+		return
+	}
+
+	// Raw mode sends the question without any of our instructions, for
+	// debugging the model; its HTML output is then escaped like any text
+	raw, _ := strconv.ParseBool(r.FormValue("raw"))
 
-	if query != "" {
-		prompt = query
-		if history != "" {
-			prompt = history + "Q: " + query
+	lang := r.FormValue("lang")
+	if lang == "" {
+		// Every browser sends Accept-Language; only another language needs asking for
+		lang = acceptLanguage(r.Header.Get("Accept-Language"))
+		if primary, _, _ := strings.Cut(lang, "-"); strings.EqualFold(primary, defaultLanguage) {
+			lang = ""
 		}
+	} else if !validLanguageTag(lang) {
+		http.Error(w, "lang must be a language tag like en or pt-BR", http.StatusBadRequest)
+		return
+	}
+
+	// Browsers may keep their history on the server instead (see session.go).
+	// A GET starts a new conversation; a POST continues the stored one.
+	var sessionID string
+	inSession := false
+	if webSessions && mode == modeHTML {
+		id, stored, ok := openSession(w, r)
+		sessionID = id
+		if ok && r.Method == "POST" {
+			history, inSession = stored, true
+		}
+	}
+	// The form only carries the history when the server isn't keeping it
+	formHistory := func(history []exchange) string {
+		if inSession {
+			return ""
+		}
+		return encodeHistory(history)
+	}
+
+	history = limitHistory(history)
 
-		if wantsHTML && r.Header.Get("Accept") != "application/json" {
+	if query == "" && jsonBody {
+		http.Error(w, `Missing query: send {"q": "your question"}`, http.StatusBadRequest)
+		return
+	}
+	if query == "" {
+		// A stream needs something to answer; say so rather than send an empty one
+		if mode == modeSSE || mode == modeNDJSON {
+			http.Error(w, "Missing query: use ?q=your+question", http.StatusBadRequest)
+			return
+		}
+		if mode == modeHTML {
 			w.Header().Set("Content-Type", "text/html; charset=utf-8")
-			w.Header().Set("Transfer-Encoding", "chunked")
-			w.Header().Set("X-Accel-Buffering", "no")
-			w.Header().Set("Cache-Control", "no-cache")
-			flusher := w.(http.Flusher)
+			fmt.Fprint(w, htmlHeader)
+			saveSession(sessionID, history)
+			writeHistoryHTML(w, history)
+			fmt.Fprintf(w, htmlFooterTemplate, html.EscapeString(formHistory(history)))
+		} else {
+			writeBody(w, r, "text/plain; charset=utf-8", []byte(transcript(history)))
+		}
+		return
+	}
 
-			headerSize := len(htmlHeader)
-			historySize := len(html.EscapeString(history))
-			querySize := len(html.EscapeString(query))
-			currentSize := headerSize + historySize + querySize + 10
+	if len(query) > maxPromptLength {
+		http.Error(w, fmt.Sprintf("Question too long: the limit is %d bytes", maxPromptLength), http.StatusRequestEntityTooLarge)
+		return
+	}
 
-			const minThreshold = 6144
+	prompt := query
+	if len(history) > 0 {
+		prompt = transcript(guardedHistory(history)) + "Q: " + query
+	}
+	if !raw {
+		protocol := "http"
+		if mode == modeHTML {
+			protocol = "html"
+		}
+		prompt = shapePrompt(protocol, prompt, promptOptions{verbosity: verbosity, lang: lang})
+	}
+	if echoPromptRequested(ctx) {
+		writePromptEcho(w, requestedModel(ctx), system, prompt)
+		return
+	}
 
-			fmt.Fprint(w, htmlHeader)
+	if !modelRateAllow(r.RemoteAddr, requestedModel(ctx)) {
+		http.Error(w, "Rate limit exceeded for this model", http.StatusTooManyRequests)
+		return
+	}
 
-			if currentSize < minThreshold {
-				paddingNeeded := (minThreshold - currentSize) / 3
-				if paddingNeeded > 0 {
-					padding := strings.Repeat("\u200B", paddingNeeded)
-					fmt.Fprint(w, padding)
-				}
-			}
+	if llmReady() != nil {
+		http.Error(w, "Service not configured, try again later", http.StatusServiceUnavailable)
+		return
+	}
 
-			if history != "" {
-				histParts := strings.Split("\n"+history, "\nQ: ")
-				for _, part := range histParts[1:] {
-					if i := strings.Index(part, "\nA: "); i >= 0 {
-						question := part[:i]
-						answer := part[i+4:]
-						answer = strings.TrimRight(answer, "\n")
-						fmt.Fprintf(w, "<div class=\"q\">%s</div>\n", html.EscapeString(question))
-						fmt.Fprintf(w, "<div class=\"a\">%s</div>\n", answer)
-					}
-				}
-			}
-			fmt.Fprintf(w, "<div class=\"q\">%s</div>\n<div class=\"a\">", html.EscapeString(query))
-			flusher.Flush()
+	release, ok := acquireIPSlot(r.RemoteAddr)
+	if !ok {
+		http.Error(w, "Too many concurrent requests", http.StatusTooManyRequests)
+		return
+	}
+	defer release()
 
-			ch := make(chan string, 10)
-			go func() {
-				htmlPrompt := htmlPromptPrefix + prompt
-				LLM(htmlPrompt, ch)
-			}()
+	switch mode {
+	case modeHTML:
+		ch := make(chan string, 10)
+		errc := make(chan error, 1)
+		go func() {
+			_, err := askLLM(ctx, prompt, ch)
+			errc <- err
+		}()
 
-			var response strings.Builder
-			for chunk := range ch {
-				if _, err := fmt.Fprint(w, chunk); err != nil {
-					return
-				}
-				response.WriteString(chunk)
-				flusher.Flush()
+		// Hold the page until the model answers, so that a failure before
+		// any output gets its 5xx status on a page of its own
+		first, answered := <-ch
+		var err error
+		if !answered {
+			if err = <-errc; err != nil {
+				status, _, message := classifyLLMError(err)
+				w.Header().Set("Content-Type", "text/html; charset=utf-8")
+				w.WriteHeader(status)
+				fmt.Fprint(w, htmlHeader)
+				writeHistoryHTML(w, history)
+				fmt.Fprintf(w, "<div class=\"q\">%s</div>\n<div class=\"a\"><p class=\"error\">Error: %s</p></div>\n", html.EscapeString(query), html.EscapeString(message))
+				fmt.Fprintf(w, htmlFooterTemplate, html.EscapeString(formHistory(history)))
+				return
 			}
-			fmt.Fprint(w, "</div>\n")
-
-			finalHistory := history + fmt.Sprintf("Q: %s\nA: %s\n\n", query, response.String())
-			fmt.Fprintf(w, htmlFooterTemplate, html.EscapeString(finalHistory))
-			return
 		}
 
-		// More strict curl detection: only exact match or curl/ prefix
-		isCurl := (userAgent == "curl" || strings.HasPrefix(userAgent, "curl/")) && !wantsHTML && !wantsJSON && !wantsStream
-		if isCurl {
-			w.Header().Set("Content-Type", "text/plain; charset=utf-8")
-			w.Header().Set("Transfer-Encoding", "chunked")
-			w.Header().Set("X-Accel-Buffering", "no")
-			flusher := w.(http.Flusher)
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.Header().Set("Transfer-Encoding", "chunked")
+		disableProxyBuffering(w)
+		w.Header().Set("Cache-Control", "no-cache")
+		flusher := flusherOf(w)
+
+		headerSize := len(htmlHeader)
+		historySize := len(html.EscapeString(formHistory(history)))
+		querySize := len(html.EscapeString(query))
+		currentSize := headerSize + historySize + querySize + 10
 
-			fmt.Fprintf(w, "Q: %s\nA: ", query)
-			flusher.Flush()
+		fmt.Fprint(w, htmlHeader)
 
-			ch := make(chan string, 10)
-			go func() {
-				LLM(prompt, ch)
-			}()
+		fmt.Fprint(w, earlyFlushPadding(currentSize, earlyFlushBytes))
 
+		writeHistoryHTML(w, history)
+		fmt.Fprintf(w, "<div class=\"q\">%s</div>\n<div class=\"a\">", html.EscapeString(query))
+		flusher.Flush()
+
+		// Answers are HTML, both here and in the history
+		toHTML := func(text string) string {
+			if raw {
+				return html.EscapeString(text)
+			}
+			return text
+		}
+		var response strings.Builder
+		var labels labelFilter
+		throttle := newStreamThrottle()
+		write := func(chunk string) bool {
+			if chunk = toHTML(labels.Write(chunk)); chunk == "" {
+				return true
+			}
+			if throttle.wait(ctx, len(chunk)) != nil {
+				return false
+			}
+			if _, err := fmt.Fprint(w, chunk); err != nil {
+				return false
+			}
+			response.WriteString(chunk)
+			flusher.Flush()
+			return true
+		}
+		if answered {
+			if !write(first) {
+				return
+			}
 			for chunk := range ch {
-				if _, err := fmt.Fprint(w, chunk); err != nil {
+				if !write(chunk) {
 					return
 				}
-				flusher.Flush()
 			}
-			fmt.Fprint(w, "\n")
-			return
-		}
-
-		promptToUse := prompt
-		if wantsHTML {
-			promptToUse = htmlPromptPrefix + prompt
+			err = <-errc
 		}
-		response, err := LLM(promptToUse, nil)
+		rest := toHTML(labels.Flush())
+		response.WriteString(rest)
+		fmt.Fprint(w, rest)
+		// Don't leave a half answer looking complete; the notice stays out of the history
 		if err != nil {
-			content = err.Error()
-			errJSON, _ := json.Marshal(map[string]string{"error": err.Error()})
-			jsonResponse = string(errJSON)
-		} else {
-			respJSON, _ := json.Marshal(map[string]string{
-				"question": query,
-				"answer":   response,
-			})
-			jsonResponse = string(respJSON)
+			message := streamErrorMessage(err, response.Len() > 0)
+			fmt.Fprintf(w, "<p class=\"error\">Error: %s</p>", html.EscapeString(message))
+		}
+		fmt.Fprint(w, "</div>\n")
 
-			newExchange := fmt.Sprintf("Q: %s\nA: %s\n\n", query, response)
-			if history != "" {
-				content = history + newExchange
-			} else {
-				content = newExchange
+		finalHistory := limitHistory(append(history, exchange{Question: query, Answer: response.String()}))
+		saveSession(sessionID, finalHistory)
+		fmt.Fprintf(w, htmlFooterTemplate, html.EscapeString(formHistory(finalHistory)))
+
+	case modeCLI:
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.Header().Set("Transfer-Encoding", "chunked")
+		disableProxyBuffering(w)
+		flusher := flusherOf(w)
+
+		fmt.Fprintf(w, "Q: %s\nA: ", query)
+		flusher.Flush()
+
+		ch := make(chan string, 10)
+		errc := make(chan error, 1)
+		go func() {
+			_, err := askLLM(ctx, prompt, ch)
+			errc <- err
+		}()
+
+		var labels labelFilter
+		throttle := newStreamThrottle()
+		started := false
+		for chunk := range ch {
+			if chunk = labels.Write(chunk); chunk == "" {
+				continue
 			}
-			if len(content) > 65536 {
-				newExchangeLen := len(newExchange)
-				if newExchangeLen > 65536 {
-					content = newExchange[:65536]
-				} else {
-					maxHistory := 65536 - newExchangeLen
-					if len(history) > maxHistory {
-						content = history[len(history)-maxHistory:] + newExchange
-					}
-				}
+			if throttle.wait(ctx, len(chunk)) != nil {
+				return
+			}
+			if _, err := fmt.Fprint(w, chunk); err != nil {
+				return
 			}
+			started = true
+			flusher.Flush()
+		}
+		fmt.Fprint(w, labels.Flush()+"\n")
+		if err := <-errc; err != nil {
+			fmt.Fprintf(w, "[Error: %s]\n", streamErrorMessage(err, started))
 		}
-	} else if history != "" {
-		content = history
-	}
 
-	if wantsStream && query != "" {
+	case modeSSE:
 		w.Header().Set("Content-Type", "text/event-stream")
+		disableProxyBuffering(w)
 		w.Header().Set("Cache-Control", "no-cache")
 		w.Header().Set("Connection", "keep-alive")
 
-		flusher, ok := w.(http.Flusher)
-		if !ok {
-			http.Error(w, "Streaming not supported", http.StatusInternalServerError)
-			return
-		}
+		flusher := flusherOf(w)
 
 		ch := make(chan string, 10)
+		errc := make(chan error, 1)
 		go func() {
-			LLM(prompt, ch)
+			_, err := askLLM(ctx, prompt, ch)
+			errc <- err
 		}()
 
-		for chunk := range ch {
-			if _, err := fmt.Fprintf(w, "data: %s\n\n", chunk); err != nil {
+		// Content arrives as "message" events, then "error" if the backend
+		// failed, and always a final "done"
+		var labels labelFilter
+		throttle := newStreamThrottle()
+		started := false
+		for chunk, ok := waitWithHeartbeat(w, flusher, ch, sseHeartbeat); ok; chunk, ok = <-ch {
+			if chunk = labels.Write(chunk); chunk == "" {
+				continue
+			}
+			if throttle.wait(ctx, len(chunk)) != nil {
+				return
+			}
+			if err := writeSSE(w, "message", chunk); err != nil {
 				return
 			}
+			started = true
 			flusher.Flush()
 		}
-		fmt.Fprintf(w, "data: [DONE]\n\n")
-		return
-	}
-
-	if wantsJSON && jsonResponse != "" {
-		w.Header().Set("Content-Type", "application/json; charset=utf-8")
-		fmt.Fprint(w, jsonResponse)
-	} else if wantsHTML && query == "" {
-		w.Header().Set("Content-Type", "text/html; charset=utf-8")
-		fmt.Fprint(w, htmlHeader)
-		parts := strings.Split("\n"+content, "\nQ: ")
-		for _, part := range parts[1:] {
-			if i := strings.Index(part, "\nA: "); i >= 0 {
-				question := part[:i]
-				answer := part[i+4:]
-				answer = strings.TrimRight(answer, "\n")
-				fmt.Fprintf(w, "<div class=\"q\">%s</div>\n", html.EscapeString(question))
-				fmt.Fprintf(w, "<div class=\"a\">%s</div>\n", answer)
-			}
+		if rest := labels.Flush(); rest != "" {
+			writeSSE(w, "message", rest)
 		}
+		if err := <-errc; err != nil {
+			data, _ := json.Marshal(map[string]string{"error": streamErrorMessage(err, started)})
+			writeSSE(w, "error", string(data))
+		}
+		writeSSE(w, "done", "[DONE]")
 
-		fmt.Fprintf(w, htmlFooterTemplate, html.EscapeString(content))
-	} else {
-		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
-		fmt.Fprint(w, content)
-	}
-}
+	case modeNDJSON:
+		w.Header().Set("Content-Type", "application/x-ndjson")
+		disableProxyBuffering(w)
+		w.Header().Set("Cache-Control", "no-cache")
 
-type ChatRequest struct {
-	Model    string    `json:"model"`
-	Messages []Message `json:"messages"`
-	Stream   bool      `json:"stream,omitempty"`
-}
+		flusher := flusherOf(w)
 
-type Message struct {
-	Role    string `json:"role"`
+		ch := make(chan string, 10)
+		errc := make(chan error, 1)
+		go func() {
+			_, err := askLLM(ctx, prompt, ch)
+			errc <- err
+		}()
+
+		enc := json.NewEncoder(w)
+		var answer strings.Builder
+		var labels labelFilter
+		throttle := newStreamThrottle()
+		for chunk := range ch {
+			if chunk = labels.Write(chunk); chunk == "" {
+				continue
+			}
+			if throttle.wait(ctx, len(chunk)) != nil {
+				return
+			}
+			if err := enc.Encode(map[string]string{"delta": chunk}); err != nil {
+				return
+			}
+			answer.WriteString(chunk)
+			flusher.Flush()
+		}
+		if rest := labels.Flush(); rest != "" {
+			enc.Encode(map[string]string{"delta": rest})
+			answer.WriteString(rest)
+		}
+		final := map[string]interface{}{"done": true, "answer": answer.String()}
+		if err := <-errc; err != nil {
+			final["error"] = streamErrorMessage(err, answer.Len() > 0)
+		}
+		enc.Encode(final)
+
+	default:
+		var input interface{} = prompt
+		if system != "" {
+			input = []map[string]string{
+				{"role": "system", "content": system},
+				{"role": "user", "content": prompt},
+			}
+		}
+		response, err := askLLM(ctx, input, nil)
+		response = trimAnswerLabel(response)
+		// A failed answer gets a 5xx status, in the shape the client asked for
+		if err != nil {
+			status, _, message := classifyLLMError(err)
+			if mode == modeJSON {
+				w.Header().Set("Content-Type", "application/json; charset=utf-8")
+				w.WriteHeader(status)
+				json.NewEncoder(w).Encode(map[string]string{"error": message})
+			} else {
+				http.Error(w, message, status)
+			}
+			return
+		}
+
+		if mode == modeJSON {
+			data, _ := json.Marshal(map[string]string{"question": query, "answer": response})
+			writeBody(w, r, "application/json; charset=utf-8", append(data, '\n'))
+			return
+		}
+		latest := exchange{Question: query, Answer: response}
+		kept := limitHistory(append(history, latest))
+		if len(kept) == 0 {
+			// Too big to carry forward, but still this request's answer
+			kept = []exchange{latest}
+		}
+		writeBody(w, r, "text/plain; charset=utf-8", []byte(transcript(kept)))
+	}
+}
+
+// writeBody sends a complete response with its Content-Length, for clients
+// that handle chunked encoding poorly; streamed responses stay chunked.
+// With the response cache on, asking again gives the same answer, so Range
+// requests are honored to let clients resume or fetch part of it.
+func writeBody(w http.ResponseWriter, r *http.Request, contentType string, body []byte) {
+	w.Header().Set("Content-Type", contentType)
+	if llmCache.ttl > 0 {
+		http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(body))
+		return
+	}
+	w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+	w.Write(body)
+}
+
+// acceptLanguage returns the most preferred language tag in an
+// Accept-Language header, or "" if it names none
+func acceptLanguage(header string) string {
+	best, bestQ := "", 0.0
+	for _, part := range strings.Split(header, ",") {
+		tag, params, _ := strings.Cut(part, ";")
+		tag = strings.TrimSpace(tag)
+		q := 1.0
+		if v, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			var err error
+			if q, err = strconv.ParseFloat(v, 64); err != nil {
+				continue
+			}
+		}
+		if q > bestQ && validLanguageTag(tag) {
+			best, bestQ = tag, q
+		}
+	}
+	return best
+}
+
+// validLanguageTag loosely checks for a BCP 47 tag: letters, digits and hyphens
+func validLanguageTag(tag string) bool {
+	if tag == "" || len(tag) > 35 || !unicode.IsLetter(rune(tag[0])) {
+		return false
+	}
+	for _, c := range tag {
+		if c != '-' && (c > unicode.MaxASCII || !unicode.IsLetter(c) && !unicode.IsDigit(c)) {
+			return false
+		}
+	}
+	return true
+}
+
+// pathQuery turns a request path like /what-is-go into a query. Paths with
+// nothing meaningful in them ("/", "//", "/-/", "/index.html") give no query,
+// so they show the chat form instead. Equivalent spellings such as
+// /what-is-go/ and /what--is-go give the same query.
+func pathQuery(path string) string {
+	for strings.Contains(path, "//") {
+		path = strings.ReplaceAll(path, "//", "/")
+	}
+	path = strings.Trim(path, "/")
+	if path == "index.html" || path == "index.htm" {
+		return ""
+	}
+	if !strings.ContainsFunc(path, func(r rune) bool { return unicode.IsLetter(r) || unicode.IsDigit(r) }) {
+		return ""
+	}
+	return strings.Join(strings.Fields(strings.ReplaceAll(path, "-", " ")), " ")
+}
+
+// writeHistoryHTML renders a "Q: ...\nA: ...\n\n" transcript as chat bubbles
+func writeHistoryHTML(w io.Writer, history []exchange) {
+	for _, e := range history {
+		fmt.Fprintf(w, "<div class=\"q\">%s</div>\n", html.EscapeString(e.Question))
+		fmt.Fprintf(w, "<div class=\"a\">%s</div>\n", e.Answer)
+	}
+}
+
+// exchange is one question and answer of a web conversation. The form
+// carries the history as JSON, so text that itself contains "Q:" or "A:"
+// can't be mistaken for the start of another exchange.
+type exchange struct {
+	Question string `json:"q"`
+	Answer   string `json:"a"`
+}
+
+// rootRequest is a JSON body posted to /. h is the history, either as
+// exchanges or encoded as in the web form.
+type rootRequest struct {
+	Q      string      `json:"q"`
+	H      jsonHistory `json:"h"`
+	Model  string      `json:"model"`
+	System string      `json:"system"`
+}
+
+type jsonHistory []exchange
+
+func (h *jsonHistory) UnmarshalJSON(data []byte) error {
+	var encoded string
+	if err := json.Unmarshal(data, &encoded); err == nil {
+		*h = parseHistory(encoded)
+		return nil
+	}
+	return json.Unmarshal(data, (*[]exchange)(h))
+}
+
+// encodeHistory writes history as JSON for the web form. Answers are HTML,
+// so escaping <, > and & as \u003c and the like would bloat the field.
+func encodeHistory(history []exchange) string {
+	if len(history) == 0 {
+		return ""
+	}
+	var b strings.Builder
+	enc := json.NewEncoder(&b)
+	enc.SetEscapeHTML(false)
+	enc.Encode(history)
+	return strings.TrimSuffix(b.String(), "\n")
+}
+
+// parseHistory reads the history field: JSON as written by the web form, or
+// the plain "Q: ...\nA: ...\n\n" transcript that text clients get back.
+func parseHistory(h string) []exchange {
+	var history []exchange
+	if strings.HasPrefix(h, "[") && json.Unmarshal([]byte(h), &history) == nil {
+		return history
+	}
+	parts := strings.Split("\n"+h, "\nQ: ")
+	for _, part := range parts[1:] {
+		if i := strings.Index(part, "\nA: "); i >= 0 {
+			history = append(history, exchange{
+				Question: part[:i],
+				Answer:   strings.TrimRight(part[i+4:], "\n"),
+			})
+		}
+	}
+	return history
+}
+
+// limitHistory keeps the most recent exchanges that fit in maxHistoryTurns
+// and maxHistoryBytes
+func limitHistory(history []exchange) []exchange {
+	if maxHistoryTurns > 0 && len(history) > maxHistoryTurns {
+		history = history[len(history)-maxHistoryTurns:]
+	}
+	size := len(transcript(history))
+	for len(history) > 0 && size > maxHistoryBytes {
+		size -= len(transcript(history[:1]))
+		history = history[1:]
+	}
+	return history
+}
+
+// transcript renders history in the plain Q:/A: form used for prompts and text clients
+func transcript(history []exchange) string {
+	var b strings.Builder
+	for _, e := range history {
+		fmt.Fprintf(&b, "Q: %s\nA: %s\n\n", e.Question, e.Answer)
+	}
+	return b.String()
+}
+
+// Transcript labels models sometimes echo at the start of a reply. Left in,
+// they would corrupt the Q:/A: history that is sent back with the next query.
+var answerLabels = []string{"A:", "Q:"}
+
+// trimAnswerLabel removes a leading answer label from a reply
+func trimAnswerLabel(reply string) string {
+	trimmed := strings.TrimLeft(reply, " \t\r\n")
+	for _, label := range answerLabels {
+		if rest, ok := strings.CutPrefix(trimmed, label); ok {
+			return strings.TrimLeft(rest, " \t\r\n")
+		}
+	}
+	return reply
+}
+
+// labelFilter applies trimAnswerLabel to a stream, holding back the start of
+// the reply until it is clear whether it begins with a label.
+type labelFilter struct {
+	head    string
+	decided bool
+}
+
+// Write adds a chunk and returns the text that is safe to emit
+func (f *labelFilter) Write(chunk string) string {
+	if f.decided {
+		return chunk
+	}
+	f.head += chunk
+	// A label plus the character after it decides
+	if len(strings.TrimLeft(f.head, " \t\r\n")) < 3 {
+		return ""
+	}
+	return f.Flush()
+}
+
+// Flush returns whatever is still held back once the stream has ended
+func (f *labelFilter) Flush() string {
+	if f.decided {
+		return ""
+	}
+	f.decided = true
+	head := f.head
+	f.head = ""
+	return trimAnswerLabel(head)
+}
+
+// responseMode is the single kind of response handleRoot gives a request
+type responseMode int
+
+const (
+	modeText   responseMode = iota // Plain-text transcript
+	modeCLI                        // Plain text streamed as it arrives, for curl and other CLI tools
+	modeHTML                       // HTML page streamed as it arrives, for browsers
+	modeJSON                       // {"question": ..., "answer": ...}
+	modeSSE                        // Server-sent events
+	modeNDJSON                     // One {"delta": ...} object per line, then {"done": true, "answer": ...}
+)
+
+var formatModes = map[string]responseMode{
+	"json":   modeJSON,
+	"text":   modeText,
+	"html":   modeHTML,
+	"stream": modeSSE,
+	"ndjson": modeNDJSON,
+}
+
+var acceptModes = map[string]responseMode{
+	"application/json":     modeJSON,
+	"text/event-stream":    modeSSE,
+	"text/html":            modeHTML,
+	"application/x-ndjson": modeNDJSON,
+}
+
+// negotiate picks the response mode for a request, in order of precedence:
+//  0. An explicit ?format=json|text|html|stream|ndjson, so a browser address
+//     bar can ask for JSON; any other value is an error.
+//  1. The Accept media type with the highest q-value among application/json,
+//     text/event-stream, text/html and application/x-ndjson; on a tie the one
+//     listed first wins.
+//     Wildcards like */* name none of them.
+//  2. A command-line tool in cliUserAgents gets streamed plain text, as long
+//     as its Accept header asks for nothing more specific than */*, text/*
+//     or text/plain (curl's default is */*).
+//  3. A browser User-Agent gets HTML.
+//  4. Everything else gets the plain-text transcript.
+func negotiate(r *http.Request) (responseMode, error) {
+	if format := r.URL.Query().Get("format"); format != "" {
+		mode, ok := formatModes[format]
+		if !ok {
+			return modeText, fmt.Errorf("invalid format %q: use json, text, html, stream or ndjson", format)
+		}
+		return mode, nil
+	}
+
+	best, bestQ := modeText, 0.0
+	for _, part := range strings.Split(r.Header.Get("Accept"), ",") {
+		mediaType, params, _ := strings.Cut(part, ";")
+		mode, ok := acceptModes[strings.ToLower(strings.TrimSpace(mediaType))]
+		if !ok {
+			continue
+		}
+		q := 1.0
+		for _, param := range strings.Split(params, ";") {
+			if k, v, ok := strings.Cut(param, "="); ok && strings.TrimSpace(k) == "q" {
+				if f, err := strconv.ParseFloat(strings.TrimSpace(v), 64); err == nil {
+					q = f
+				}
+			}
+		}
+		if q > bestQ {
+			best, bestQ = mode, q
+		}
+	}
+	if bestQ > 0 {
+		return best, nil
+	}
+
+	userAgent := r.Header.Get("User-Agent")
+	if isCLIUA(userAgent) && acceptsPlainText(r.Header.Get("Accept")) {
+		return modeCLI, nil
+	}
+	if isBrowserUA(userAgent) {
+		return modeHTML, nil
+	}
+	return modeText, nil
+}
+
+// acceptsPlainText reports whether an Accept header is absent or names only
+// wildcards and text/plain
+func acceptsPlainText(accept string) bool {
+	for _, part := range strings.Split(accept, ",") {
+		mediaType, _, _ := strings.Cut(part, ";")
+		switch strings.ToLower(strings.TrimSpace(mediaType)) {
+		case "", "*/*", "text/*", "text/plain":
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+type ChatRequest struct {
+	Model    string        `json:"model"`
+	Messages []Message     `json:"messages"`
+	Stream   bool          `json:"stream,omitempty"`
+	Stop     StopSequences `json:"stop,omitempty"`
+	N        int           `json:"n,omitempty"`
+}
+
+// StopSequences accepts "stop" as either a single string or an array
+type StopSequences []string
+
+func (s *StopSequences) UnmarshalJSON(data []byte) error {
+	var one string
+	if err := json.Unmarshal(data, &one); err == nil {
+		*s = StopSequences{one}
+		return nil
+	}
+	var many []string
+	if err := json.Unmarshal(data, &many); err != nil {
+		return err
+	}
+	*s = many
+	return nil
+}
+
+// truncateAtStop cuts text at the earliest stop sequence, reporting whether one was found
+func truncateAtStop(text string, stops []string) (string, bool) {
+	cut := -1
+	for _, stop := range stops {
+		if stop == "" {
+			continue
+		}
+		if i := strings.Index(text, stop); i >= 0 && (cut < 0 || i < cut) {
+			cut = i
+		}
+	}
+	if cut < 0 {
+		return text, false
+	}
+	return text[:cut], true
+}
+
+// stopFilter holds back the tail of a stream so a stop sequence split
+// across two chunks is still caught before any of it is emitted.
+type stopFilter struct {
+	stops   []string
+	hold    int
+	pending string
+}
+
+func newStopFilter(stops []string) *stopFilter {
+	f := &stopFilter{stops: stops}
+	for _, stop := range stops {
+		if len(stop)-1 > f.hold {
+			f.hold = len(stop) - 1
+		}
+	}
+	return f
+}
+
+// Write adds a chunk and returns the text that is safe to emit.
+// stopped reports that a stop sequence was hit and the stream should end.
+func (f *stopFilter) Write(chunk string) (text string, stopped bool) {
+	f.pending += chunk
+	if text, found := truncateAtStop(f.pending, f.stops); found {
+		f.pending = ""
+		return text, true
+	}
+
+	// Keep up to hold bytes, without splitting a UTF-8 sequence
+	cut := len(f.pending) - f.hold
+	if cut < 0 {
+		cut = 0
+	}
+	for cut > 0 && cut < len(f.pending) && !utf8.RuneStart(f.pending[cut]) {
+		cut--
+	}
+	text, f.pending = f.pending[:cut], f.pending[cut:]
+	return text, false
+}
+
+// Flush returns whatever is still held back once the stream has ended
+func (f *stopFilter) Flush() string {
+	text := f.pending
+	f.pending = ""
+	return text
+}
+
+type Message struct {
+	Role    string `json:"role"`
 	Content string `json:"content"`
 }
 
+// Roles accepted in /v1/chat/completions messages
+var messageRoles = map[string]bool{
+	"system":    true,
+	"developer": true,
+	"user":      true,
+	"assistant": true,
+	"tool":      true,
+}
+
+// buildMessages converts messages for LLM(). System and developer messages,
+// wherever they appear, are joined in order into one leading system message
+// so every backend treats them as instructions rather than conversation.
+func buildMessages(msgs []Message) []map[string]string {
+	var system []string
+	var messages []map[string]string
+	for _, msg := range msgs {
+		if msg.Role == "system" || msg.Role == "developer" {
+			system = append(system, msg.Content)
+			continue
+		}
+		messages = append(messages, map[string]string{
+			"role":    msg.Role,
+			"content": msg.Content,
+		})
+	}
+	if len(system) > 0 {
+		messages = append([]map[string]string{{
+			"role":    "system",
+			"content": strings.Join(system, "\n\n"),
+		}}, messages...)
+	}
+	return messages
+}
+
+// validateMessages requires a known role on every message and at least one
+// message with non-blank content, so an empty prompt never reaches the model.
+func validateMessages(messages []Message) error {
+	hasContent := false
+	for i, msg := range messages {
+		if !messageRoles[msg.Role] {
+			return fmt.Errorf("messages[%d]: invalid role %q", i, msg.Role)
+		}
+		if strings.TrimSpace(msg.Content) != "" {
+			hasContent = true
+		}
+	}
+	if !hasContent {
+		return errors.New("messages must include at least one message with content")
+	}
+	return nil
+}
+
 type ChatResponse struct {
 	ID      string   `json:"id"`
 	Object  string   `json:"object"`
@@ -319,105 +1342,425 @@ type ChatResponse struct {
 }
 
 type Choice struct {
-	Index   int     `json:"index"`
-	Message Message `json:"message"`
+	Index        int     `json:"index"`
+	Message      Message `json:"message"`
+	FinishReason string  `json:"finish_reason"`
 }
 
-func handleChatCompletions(w http.ResponseWriter, r *http.Request) {
-	w.Header().Set("Access-Control-Allow-Origin", "*")
-	w.Header().Set("Access-Control-Allow-Methods", "POST, OPTIONS")
-	w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization")
-	w.Header().Set("Access-Control-Max-Age", "86400")
+type ErrorResponse struct {
+	Error APIError `json:"error"`
+}
 
-	if r.Method == "OPTIONS" {
-		w.WriteHeader(http.StatusOK)
+type APIError struct {
+	Message string `json:"message"`
+	Type    string `json:"type"`
+	Code    string `json:"code"`
+}
+
+// writeAPIError writes an error in the envelope OpenAI clients expect
+func writeAPIError(w http.ResponseWriter, status int, errType, code, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(ErrorResponse{APIError{
+		Message: message,
+		Type:    errType,
+		Code:    code,
+	}})
+}
+
+// handleAPINotFound answers unknown /v1/ routes in the error shape OpenAI
+// SDKs understand, instead of a plain-text 404
+func handleAPINotFound(w http.ResponseWriter, r *http.Request) {
+	if allowCORS(w, r, "GET, POST, OPTIONS") {
+		return
+	}
+	writeAPIError(w, http.StatusNotFound, "invalid_request_error", "unknown_url", fmt.Sprintf("Unknown request URL: %s %s", r.Method, r.URL.Path))
+}
+
+func handleChatCompletions(w http.ResponseWriter, r *http.Request) {
+	if allowCORS(w, r, "POST, OPTIONS") {
 		return
 	}
 
 	if !rateLimitAllow(r.RemoteAddr) {
-		http.Error(w, "Rate limit exceeded", http.StatusTooManyRequests)
+		writeAPIError(w, http.StatusTooManyRequests, "requests", "rate_limit_exceeded", "Rate limit exceeded")
 		return
 	}
 
 	if r.Method != "POST" {
 		w.Header().Set("Allow", "POST, OPTIONS")
-		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		writeAPIError(w, http.StatusMethodNotAllowed, "invalid_request_error", "method_not_allowed", "Method not allowed")
 		return
 	}
 
 	var req ChatRequest
+	r.Body = http.MaxBytesReader(w, r.Body, maxAPIBody)
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			writeAPIError(w, http.StatusRequestEntityTooLarge, "invalid_request_error", "request_too_large", fmt.Sprintf("Request body exceeds %d bytes", maxAPIBody))
+			return
+		}
+		writeAPIError(w, http.StatusBadRequest, "invalid_request_error", "invalid_json", "Invalid JSON")
 		return
 	}
 
-	messages := make([]map[string]string, len(req.Messages))
-	for i, msg := range req.Messages {
-		messages[i] = map[string]string{
-			"role":    msg.Role,
-			"content": msg.Content,
-		}
+	if err := validateMessages(req.Messages); err != nil {
+		writeAPIError(w, http.StatusBadRequest, "invalid_request_error", "invalid_messages", err.Error())
+		return
 	}
 
+	promptLength := 0
+	for _, msg := range req.Messages {
+		promptLength += len(msg.Content)
+	}
+	if promptLength > maxAPIPromptLength {
+		writeAPIError(w, http.StatusBadRequest, "invalid_request_error", "context_length_exceeded", fmt.Sprintf("Messages are %d bytes long; the limit is %d", promptLength, maxAPIPromptLength))
+		return
+	}
+
+	if !modelRateAllow(r.RemoteAddr, protocolModels["api"]) {
+		writeAPIError(w, http.StatusTooManyRequests, "requests", "rate_limit_exceeded", "Rate limit exceeded for this model")
+		return
+	}
+
+	if llmReady() != nil {
+		writeAPIError(w, http.StatusServiceUnavailable, "server_error", "not_configured", "Service not configured, try again later")
+		return
+	}
+
+	release, ok := acquireIPSlot(r.RemoteAddr)
+	if !ok {
+		writeAPIError(w, http.StatusTooManyRequests, "requests", "too_many_concurrent_requests", "Too many concurrent requests")
+		return
+	}
+	defer release()
+
+	ctx, cancel := context.WithTimeout(withProtocolModel(r.Context(), "api"), llmTimeout)
+	defer cancel()
+
+	n := req.N
+	if n < 1 {
+		n = 1
+	} else if n > maxChoices {
+		n = maxChoices
+	}
+	// Cached or coalesced calls would make every choice the same
+	if n > 1 {
+		ctx = withoutCache(ctx)
+	}
+
+	// Every chunk of the completion shares an id and its creation time. The
+	// id names the request ID for tracing, plus a random part so clients that
+	// reuse an X-Request-ID still get a unique id per completion.
+	id := "chatcmpl-" + requestID(r.Context()) + "-" + newRequestID()[:8]
+	created := time.Now().Unix()
+	messages := buildMessages(req.Messages)
+
 	if req.Stream {
 		w.Header().Set("Content-Type", "text/event-stream")
+		disableProxyBuffering(w)
 		w.Header().Set("Cache-Control", "no-cache")
 		w.Header().Set("Connection", "keep-alive")
 
-		flusher, ok := w.(http.Flusher)
-		if !ok {
-			http.Error(w, "Streaming not supported", http.StatusInternalServerError)
-			return
-		}
+		flusher := flusherOf(w)
 
-		ch := make(chan string, 10)
-		go LLM(messages, ch)
-
-		for chunk := range ch {
+		writeChunk := func(index int, delta map[string]string, finishReason interface{}) bool {
 			resp := map[string]interface{}{
-				"id":      fmt.Sprintf("chatcmpl-%d", time.Now().Unix()),
+				"id":      id,
 				"object":  "chat.completion.chunk",
-				"created": time.Now().Unix(),
+				"created": created,
 				"model":   req.Model,
 				"choices": []map[string]interface{}{{
-					"index": 0,
-					"delta": map[string]string{"content": chunk},
+					"index":         index,
+					"delta":         delta,
+					"finish_reason": finishReason,
 				}},
 			}
 			data, err := json.Marshal(resp)
 			if err != nil {
 				fmt.Fprintf(w, "data: Failed to marshal response\n\n")
-				return
+				return false
 			}
 			if _, err := fmt.Fprintf(w, "data: %s\n\n", data); err != nil {
-				return
+				return false
 			}
 			flusher.Flush()
+			return true
+		}
+
+		// Each choice streams from its own LLM call; chunks are interleaved by index
+		type streamDelta struct {
+			index int
+			text  string
+			done  bool
+			cut   bool // Done, but cut off by llmTimeout
+			err   error
+		}
+		deltas := make(chan streamDelta)
+		var wg sync.WaitGroup
+		for i := 0; i < n; i++ {
+			wg.Add(1)
+			go func(index int) {
+				defer wg.Done()
+				streamCtx, streamCancel := context.WithCancel(ctx)
+				defer streamCancel()
+
+				ch := make(chan string, 10)
+				errc := make(chan error, 1)
+				go func() {
+					_, err := askLLM(streamCtx, messages, ch)
+					errc <- err
+				}()
+
+				// Sends only give up once the handler has returned, so a
+				// choice cut off by llmTimeout can still be finished
+				send := func(d streamDelta) bool {
+					select {
+					case deltas <- d:
+						return true
+					case <-r.Context().Done():
+						return false
+					}
+				}
+
+				stop := newStopFilter(req.Stop)
+				stopped, started := false, false
+				for chunk := range ch {
+					var text string
+					text, stopped = stop.Write(chunk)
+					if text != "" && !send(streamDelta{index: index, text: text}) {
+						return
+					}
+					started = started || text != ""
+					if stopped {
+						streamCancel()
+						break
+					}
+				}
+				if text := stop.Flush(); text != "" && !send(streamDelta{index: index, text: text}) {
+					return
+				}
+				// Cancelling at a stop sequence isn't a failure, and a
+				// choice cut off by llmTimeout ends like one cut off by max_tokens
+				err := <-errc
+				if err != nil && !stopped && started && errors.Is(err, context.DeadlineExceeded) {
+					send(streamDelta{index: index, done: true, cut: true})
+					return
+				}
+				if err != nil && !stopped {
+					send(streamDelta{index: index, err: err})
+					return
+				}
+				send(streamDelta{index: index, done: true})
+			}(i)
+		}
+		go func() {
+			wg.Wait()
+			close(deltas)
+		}()
+
+		throttle := newStreamThrottle()
+		for d, ok := waitWithHeartbeat(w, flusher, deltas, sseHeartbeat); ok; d, ok = <-deltas {
+			if throttle.wait(ctx, len(d.text)) != nil {
+				return
+			}
+			var written bool
+			if d.err != nil {
+				// Content stays in plain data lines for OpenAI clients; only failures get a named event
+				_, code, message := classifyLLMError(d.err)
+				data, _ := json.Marshal(ErrorResponse{APIError{Message: message, Type: "server_error", Code: code}})
+				written = writeSSE(w, "error", string(data)) == nil
+				flusher.Flush()
+			} else if d.done && d.cut {
+				written = writeChunk(d.index, map[string]string{}, "length")
+			} else if d.done {
+				written = writeChunk(d.index, map[string]string{}, "stop")
+			} else {
+				written = writeChunk(d.index, map[string]string{"content": d.text}, nil)
+			}
+			if !written {
+				return
+			}
 		}
 		fmt.Fprintf(w, "data: [DONE]\n\n")
 
 	} else {
-		response, err := LLM(messages, nil)
-		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
+		choices := make([]Choice, n)
+		errs := make([]error, n)
+		var wg sync.WaitGroup
+		for i := range choices {
+			wg.Add(1)
+			go func(index int) {
+				defer wg.Done()
+				response, err := askLLM(ctx, messages, nil)
+				response, _ = truncateAtStop(response, req.Stop)
+				choices[index] = Choice{
+					Index: index,
+					Message: Message{
+						Role:    "assistant",
+						Content: response,
+					},
+					FinishReason: "stop",
+				}
+				errs[index] = err
+			}(i)
+		}
+		wg.Wait()
+
+		for _, err := range errs {
+			if err != nil {
+				status, code, message := classifyLLMError(err)
+				writeAPIError(w, status, "server_error", code, message)
+				return
+			}
 		}
 
 		chatResp := ChatResponse{
-			ID:      fmt.Sprintf("chatcmpl-%d", time.Now().Unix()),
+			ID:      id,
 			Object:  "chat.completion",
-			Created: time.Now().Unix(),
+			Created: created,
 			Model:   req.Model,
-			Choices: []Choice{{
-				Index: 0,
-				Message: Message{
-					Role:    "assistant",
-					Content: response,
-				},
-			}},
+			Choices: choices,
 		}
 
 		w.Header().Set("Content-Type", "application/json")
 		json.NewEncoder(w).Encode(chatResp)
 	}
 }
+
+type EmbeddingRequest struct {
+	Model string         `json:"model"`
+	Input EmbeddingInput `json:"input"`
+}
+
+// EmbeddingInput accepts "input" as either a single string or an array
+type EmbeddingInput []string
+
+func (in *EmbeddingInput) UnmarshalJSON(data []byte) error {
+	var one string
+	if err := json.Unmarshal(data, &one); err == nil {
+		*in = EmbeddingInput{one}
+		return nil
+	}
+	var many []string
+	if err := json.Unmarshal(data, &many); err != nil {
+		return errors.New("input must be a string or an array of strings")
+	}
+	*in = many
+	return nil
+}
+
+type EmbeddingResponse struct {
+	Object string         `json:"object"`
+	Data   []Embedding    `json:"data"`
+	Model  string         `json:"model"`
+	Usage  EmbeddingUsage `json:"usage"`
+}
+
+type Embedding struct {
+	Object    string    `json:"object"`
+	Index     int       `json:"index"`
+	Embedding []float64 `json:"embedding"`
+}
+
+type EmbeddingUsage struct {
+	PromptTokens int `json:"prompt_tokens"`
+	TotalTokens  int `json:"total_tokens"`
+}
+
+// handleEmbeddings passes embedding requests through to the backend, for
+// OpenAI clients that use the same base URL for chat and embeddings
+func handleEmbeddings(w http.ResponseWriter, r *http.Request) {
+	if allowCORS(w, r, "POST, OPTIONS") {
+		return
+	}
+
+	if !rateLimitAllow(r.RemoteAddr) {
+		writeAPIError(w, http.StatusTooManyRequests, "requests", "rate_limit_exceeded", "Rate limit exceeded")
+		return
+	}
+
+	if r.Method != "POST" {
+		w.Header().Set("Allow", "POST, OPTIONS")
+		writeAPIError(w, http.StatusMethodNotAllowed, "invalid_request_error", "method_not_allowed", "Method not allowed")
+		return
+	}
+
+	if llmEmbed == nil {
+		writeAPIError(w, http.StatusNotImplemented, "invalid_request_error", "embeddings_unsupported", "Embeddings are not supported by this server's model backend")
+		return
+	}
+
+	var req EmbeddingRequest
+	r.Body = http.MaxBytesReader(w, r.Body, maxAPIBody)
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			writeAPIError(w, http.StatusRequestEntityTooLarge, "invalid_request_error", "request_too_large", fmt.Sprintf("Request body exceeds %d bytes", maxAPIBody))
+			return
+		}
+		writeAPIError(w, http.StatusBadRequest, "invalid_request_error", "invalid_json", "Invalid JSON")
+		return
+	}
+
+	if len(req.Input) == 0 || slices.Contains(req.Input, "") {
+		writeAPIError(w, http.StatusBadRequest, "invalid_request_error", "invalid_input", "input must be a non-empty string or array of non-empty strings")
+		return
+	}
+
+	// Like /, only models the operator chose may be spent on
+	if !embeddingModelAllowed(req.Model) {
+		writeAPIError(w, http.StatusBadRequest, "invalid_request_error", "model_not_found", fmt.Sprintf("Model %q is not available", req.Model))
+		return
+	}
+
+	if !modelRateAllow(r.RemoteAddr, req.Model) {
+		writeAPIError(w, http.StatusTooManyRequests, "requests", "rate_limit_exceeded", "Rate limit exceeded for this model")
+		return
+	}
+
+	if llmReady() != nil {
+		writeAPIError(w, http.StatusServiceUnavailable, "server_error", "not_configured", "Service not configured, try again later")
+		return
+	}
+
+	release, ok := acquireIPSlot(r.RemoteAddr)
+	if !ok {
+		writeAPIError(w, http.StatusTooManyRequests, "requests", "too_many_concurrent_requests", "Too many concurrent requests")
+		return
+	}
+	defer release()
+
+	ctx, cancel := context.WithTimeout(r.Context(), llmTimeout)
+	defer cancel()
+
+	var vectors [][]float64
+	var tokens int
+	slot, err := acquireLLMSlot(ctx)
+	if err == nil {
+		vectors, tokens, err = llmEmbed(ctx, req.Model, req.Input)
+		slot()
+	}
+	if err == nil && len(vectors) != len(req.Input) {
+		err = fmt.Errorf("backend returned %d embeddings for %d inputs", len(vectors), len(req.Input))
+	}
+	if err != nil {
+		status, code, message := classifyLLMError(err)
+		writeAPIError(w, status, "server_error", code, message)
+		return
+	}
+
+	resp := EmbeddingResponse{
+		Object: "list",
+		Data:   make([]Embedding, len(vectors)),
+		Model:  req.Model,
+		Usage:  EmbeddingUsage{PromptTokens: tokens, TotalTokens: tokens},
+	}
+	for i, v := range vectors {
+		resp.Data[i] = Embedding{Object: "embedding", Index: i, Embedding: v}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
@@ -0,0 +1,2056 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html"
+	"maps"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+	"unicode/utf8"
+)
+
+func TestBackendHeaderNamesAnsweringUpstream(t *testing.T) {
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		recordBackend(r.Context(), "api.example.com")
+		w.Write([]byte("answer"))
+	})
+	ctx, rec := withBackendRecord(context.Background())
+	w := httptest.NewRecorder()
+	h.ServeHTTP(&backendHeaderWriter{ResponseWriter: w, rec: rec}, newTestRequest("GET", "/", nil).WithContext(ctx))
+	if got := w.Header().Get("X-LLM-Backend"); got != "api.example.com" {
+		t.Errorf("X-LLM-Backend = %q, want api.example.com", got)
+	}
+}
+
+func TestBackendHeaderOmittedWithoutAnswer(t *testing.T) {
+	_, rec := withBackendRecord(context.Background())
+	w := httptest.NewRecorder()
+	bw := &backendHeaderWriter{ResponseWriter: w, rec: rec}
+	http.Error(bw, "bad request", http.StatusBadRequest)
+	if _, ok := w.Header()["X-Llm-Backend"]; ok {
+		t.Error("X-LLM-Backend set though no backend answered")
+	}
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("status %d, want 400", w.Code)
+	}
+}
+
+func TestBackendHeaderWriterFlushes(t *testing.T) {
+	_, rec := withBackendRecord(context.Background())
+	w := httptest.NewRecorder()
+	flusherOf(&backendHeaderWriter{ResponseWriter: w, rec: rec}).Flush()
+	if !w.Flushed {
+		t.Error("Flush didn't reach the underlying writer")
+	}
+}
+
+// leaveAfterFirstChunk is a backend that streams until ctx is done, with a
+// client that goes away (cancel) once the first chunk is out. cancelled is
+// closed if the backend then sees ctx end.
+func leaveAfterFirstChunk(cancel context.CancelFunc, cancelled chan<- struct{}) llmFunc {
+	return func(ctx context.Context, input interface{}, stream chan<- string) (string, error) {
+		defer close(stream)
+		stream <- "first"
+		cancel()
+		select {
+		case <-ctx.Done():
+			close(cancelled)
+			return "", ctx.Err()
+		case <-time.After(2 * time.Second):
+			return "", nil
+		}
+	}
+}
+
+func TestRootCancelsUpstreamWhenClientLeaves(t *testing.T) {
+	for _, accept := range []string{"text/event-stream", "application/x-ndjson", "text/html"} {
+		t.Run(accept, func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			cancelled := make(chan struct{})
+			stubLLM(t, leaveAfterFirstChunk(cancel, cancelled))
+
+			r := newTestRequest("GET", "/?q=count+forever", nil).WithContext(ctx)
+			r.Header.Set("Accept", accept)
+			serve(handleRoot, r)
+			select {
+			case <-cancelled:
+			default:
+				t.Error("upstream call not cancelled when the client went away")
+			}
+		})
+	}
+}
+
+func TestChatCompletionsStreamCancelsUpstreamWhenClientLeaves(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancelled := make(chan struct{})
+	stubLLM(t, leaveAfterFirstChunk(cancel, cancelled))
+
+	r := newTestRequest("POST", "/v1/chat/completions", strings.NewReader(`{"messages":[{"role":"user","content":"count forever"}],"stream":true}`)).WithContext(ctx)
+	serve(handleChatCompletions, r)
+	select {
+	case <-cancelled:
+	case <-time.After(time.Second):
+		t.Error("upstream call not cancelled when the client went away")
+	}
+}
+
+// withDeadline gives r a deadline d from now, standing in for llmTimeout
+func withDeadline(t *testing.T, r *http.Request, d time.Duration) *http.Request {
+	ctx, cancel := context.WithTimeout(r.Context(), d)
+	t.Cleanup(cancel)
+	return r.WithContext(ctx)
+}
+
+func TestRootTimesOutSlowBackend(t *testing.T) {
+	stubLLM(t, slowReply(time.Second, "too late"))
+	w := serve(handleRoot, withDeadline(t, newTestRequest("GET", "/?q=slow", nil), 20*time.Millisecond))
+	if w.Code != http.StatusGatewayTimeout {
+		t.Errorf("status %d, want 504", w.Code)
+	}
+	if !strings.Contains(w.Body.String(), "Timed out") {
+		t.Errorf("body %q doesn't say it timed out", w.Body.String())
+	}
+}
+
+func TestChatCompletionsTimesOutSlowBackend(t *testing.T) {
+	stubLLM(t, slowReply(time.Second, "too late"))
+	r := newTestRequest("POST", "/v1/chat/completions", strings.NewReader(`{"messages":[{"role":"user","content":"slow"}]}`))
+	w := serve(handleChatCompletions, withDeadline(t, r, 20*time.Millisecond))
+	if w.Code != http.StatusGatewayTimeout {
+		t.Errorf("status %d, want 504", w.Code)
+	}
+	if !strings.Contains(w.Body.String(), `"code":"timeout"`) {
+		t.Errorf("body %q lacks the timeout code", w.Body.String())
+	}
+}
+
+func TestRootStreamEndsAtDeadline(t *testing.T) {
+	stubLLM(t, slowReply(time.Second, "too late"))
+	r := newTestRequest("GET", "/?q=slow", nil)
+	r.Header.Set("User-Agent", "curl/8.4.0")
+	start := time.Now()
+	w := serve(handleRoot, withDeadline(t, r, 20*time.Millisecond))
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Errorf("stream took %s, past its deadline", elapsed)
+	}
+	if !strings.Contains(w.Body.String(), "[Error: Timed out") {
+		t.Errorf("body %q lacks the timeout notice", w.Body.String())
+	}
+}
+
+func TestStreamsCutOffAtLimit(t *testing.T) {
+	stubLLM(t, endlessReply(30*time.Millisecond, "more "))
+
+	r := newTestRequest("GET", "/?q=endless", nil)
+	r.Header.Set("User-Agent", "curl/8.4.0")
+	body := serve(handleRoot, r).Body.String()
+	if want := fmt.Sprintf("more \n[Error: Answer cut off after %s]\n", llmTimeout); !strings.Contains(body, "A: more ") || !strings.HasSuffix(body, want) {
+		t.Errorf("/: body %q doesn't end with %q", body, want)
+	}
+
+	chunks := streamCompletion(t, `{"messages":[{"role":"user","content":"endless"}],"stream":true}`)
+	last := chunks[len(chunks)-1].Choices[0]
+	if len(chunks) < 3 || last.FinishReason == nil || *last.FinishReason != "length" {
+		t.Errorf("/v1: %d chunks, last %+v, want content then finish_reason length", len(chunks), last)
+	}
+}
+
+// apiError decodes an OpenAI-style error body
+func apiError(t *testing.T, w *httptest.ResponseRecorder) APIError {
+	t.Helper()
+	var resp ErrorResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil || resp.Error.Message == "" || resp.Error.Type == "" {
+		t.Fatalf("body %q is not an OpenAI-style error", w.Body.String())
+	}
+	if ct := w.Header().Get("Content-Type"); ct != "application/json" {
+		t.Errorf("Content-Type %q, want application/json", ct)
+	}
+	return resp.Error
+}
+
+func TestChatCompletionsErrorShape(t *testing.T) {
+	const valid = `{"messages":[{"role":"user","content":"hi"}]}`
+	tests := []struct {
+		name    string
+		method  string
+		body    string
+		backend llmFunc
+		status  int
+		code    string
+	}{
+		{"wrong method", "GET", "", nil, http.StatusMethodNotAllowed, "method_not_allowed"},
+		{"invalid JSON", "POST", "{", nil, http.StatusBadRequest, "invalid_json"},
+		{"backend error", "POST", valid, failWith(errors.New("upstream exploded")), http.StatusInternalServerError, "backend_error"},
+		{"server busy", "POST", valid, failWith(errServerBusy), http.StatusServiceUnavailable, "server_busy"},
+		{"not configured", "POST", valid, failWith(errNotConfigured), http.StatusServiceUnavailable, "not_configured"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.backend != nil {
+				stubLLM(t, tt.backend)
+			}
+			w := serve(handleChatCompletions, newTestRequest(tt.method, "/v1/chat/completions", strings.NewReader(tt.body)))
+			if w.Code != tt.status {
+				t.Errorf("status %d, want %d", w.Code, tt.status)
+			}
+			if e := apiError(t, w); e.Code != tt.code {
+				t.Errorf("code %q, want %q", e.Code, tt.code)
+			}
+		})
+	}
+}
+
+func TestChatCompletionsRateLimitErrorShape(t *testing.T) {
+	addr := testAddr()
+	var w *httptest.ResponseRecorder
+	for i := 0; i < 20; i++ {
+		r := newTestRequest("GET", "/v1/chat/completions", nil)
+		r.RemoteAddr = addr
+		if w = serve(handleChatCompletions, r); w.Code == http.StatusTooManyRequests {
+			break
+		}
+	}
+	if w.Code != http.StatusTooManyRequests {
+		t.Fatalf("status %d after 20 quick requests, want 429", w.Code)
+	}
+	if e := apiError(t, w); e.Code != "rate_limit_exceeded" {
+		t.Errorf("code %q, want rate_limit_exceeded", e.Code)
+	}
+}
+
+// sseEvent is one server-sent event
+type sseEvent struct {
+	event string
+	data  string
+}
+
+// parseSSE splits a server-sent event stream into events, skipping comments
+func parseSSE(body string) []sseEvent {
+	var events []sseEvent
+	for _, block := range strings.Split(body, "\n\n") {
+		var e sseEvent
+		var data []string
+		for _, line := range strings.Split(block, "\n") {
+			if v, ok := strings.CutPrefix(line, "event: "); ok {
+				e.event = v
+			} else if v, ok := strings.CutPrefix(line, "data: "); ok {
+				data = append(data, v)
+			}
+		}
+		if data != nil {
+			e.data = strings.Join(data, "\n")
+			events = append(events, e)
+		}
+	}
+	return events
+}
+
+// completionChunk is the part of a streamed chat completion chunk the tests read
+type completionChunk struct {
+	ID      string `json:"id"`
+	Created int64  `json:"created"`
+	Model   string `json:"model"`
+	Choices []struct {
+		Index        int               `json:"index"`
+		Delta        map[string]string `json:"delta"`
+		FinishReason *string           `json:"finish_reason"`
+	} `json:"choices"`
+}
+
+// streamCompletion posts a streaming chat completion request and decodes its chunks
+func streamCompletion(t *testing.T, body string) []completionChunk {
+	t.Helper()
+	w := serve(handleChatCompletions, newTestRequest("POST", "/v1/chat/completions", strings.NewReader(body)))
+	var chunks []completionChunk
+	for _, e := range parseSSE(w.Body.String()) {
+		if e.event != "" || e.data == "[DONE]" {
+			continue
+		}
+		var c completionChunk
+		if err := json.Unmarshal([]byte(e.data), &c); err != nil {
+			t.Fatalf("chunk %q: %v", e.data, err)
+		}
+		chunks = append(chunks, c)
+	}
+	if len(chunks) == 0 {
+		t.Fatalf("no chunks in %q", w.Body.String())
+	}
+	return chunks
+}
+
+func TestCompletionIDStableWithinStream(t *testing.T) {
+	stubLLM(t, replyWith("one ", "two ", "three"))
+	chunks := streamCompletion(t, `{"messages":[{"role":"user","content":"count"}],"stream":true}`)
+	id := chunks[0].ID
+	if !strings.HasPrefix(id, "chatcmpl-") {
+		t.Errorf("id %q lacks the chatcmpl- prefix", id)
+	}
+	for _, c := range chunks {
+		if c.ID != id {
+			t.Fatalf("chunk id %q differs from the first chunk's %q", c.ID, id)
+		}
+	}
+}
+
+func TestCompletionCreatedStableWithinStream(t *testing.T) {
+	if testing.Short() {
+		t.Skip("waits for the clock to pass a second")
+	}
+	// The second chunk comes after the clock has moved on to the next second
+	stubLLM(t, func(ctx context.Context, input interface{}, stream chan<- string) (string, error) {
+		defer close(stream)
+		stream <- "one "
+		time.Sleep(time.Until(time.Now().Truncate(time.Second).Add(time.Second + 10*time.Millisecond)))
+		stream <- "two"
+		return "", nil
+	})
+	chunks := streamCompletion(t, `{"model":"test-model","messages":[{"role":"user","content":"count"}],"stream":true}`)
+	first := chunks[0]
+	if first.Created == 0 || first.Model != "test-model" {
+		t.Fatalf("first chunk: created %d, model %q", first.Created, first.Model)
+	}
+	for _, c := range chunks {
+		if c.Created != first.Created || c.Model != first.Model {
+			t.Errorf("chunk created %d, model %q; first chunk's %d, %q", c.Created, c.Model, first.Created, first.Model)
+		}
+	}
+}
+
+func TestCompletionIDUniqueAcrossRequests(t *testing.T) {
+	stubLLM(t, replyWith("hello"))
+	seen := make(map[string]bool)
+	for i := 0; i < 20; i++ {
+		r := newTestRequest("POST", "/v1/chat/completions", strings.NewReader(`{"messages":[{"role":"user","content":"hi"}]}`))
+		// Clients may send the same X-Request-ID every time
+		r = r.WithContext(withRequestID(r.Context(), "fixed-id"))
+		var resp ChatResponse
+		if err := json.Unmarshal(serve(handleChatCompletions, r).Body.Bytes(), &resp); err != nil {
+			t.Fatal(err)
+		}
+		if seen[resp.ID] {
+			t.Fatalf("id %q issued twice", resp.ID)
+		}
+		seen[resp.ID] = true
+	}
+}
+
+func TestTruncateAtStop(t *testing.T) {
+	tests := []struct {
+		text  string
+		stops []string
+		want  string
+		found bool
+	}{
+		{"hello world", nil, "hello world", false},
+		{"hello world", []string{"o w"}, "hell", true},
+		{"hello world", []string{"world", "l"}, "he", true},
+		{"hello world", []string{"", "x"}, "hello world", false},
+		{"END at start", []string{"END"}, "", true},
+	}
+	for _, tt := range tests {
+		got, found := truncateAtStop(tt.text, tt.stops)
+		if got != tt.want || found != tt.found {
+			t.Errorf("truncateAtStop(%q, %q) = %q, %v; want %q, %v", tt.text, tt.stops, got, found, tt.want, tt.found)
+		}
+	}
+}
+
+// runStopFilter feeds chunks through a stopFilter like the stream handler does
+func runStopFilter(stops []string, chunks ...string) (string, bool) {
+	f := newStopFilter(stops)
+	var out strings.Builder
+	for _, chunk := range chunks {
+		text, stopped := f.Write(chunk)
+		out.WriteString(text)
+		if stopped {
+			return out.String(), true
+		}
+	}
+	out.WriteString(f.Flush())
+	return out.String(), false
+}
+
+func TestStopFilter(t *testing.T) {
+	tests := []struct {
+		name    string
+		stops   []string
+		chunks  []string
+		want    string
+		stopped bool
+	}{
+		{"no stops", nil, []string{"a", "b"}, "ab", false},
+		{"single", []string{"STOP"}, []string{"one STOP two"}, "one ", true},
+		{"spanning chunks", []string{"STOP"}, []string{"one ST", "OP two"}, "one ", true},
+		{"spanning three chunks", []string{"STOP"}, []string{"one S", "T", "OP"}, "one ", true},
+		{"earliest of several", []string{"two", "one"}, []string{"zero o", "ne two"}, "zero ", true},
+		{"partial match released", []string{"STOP"}, []string{"ST", "ART"}, "START", false},
+		{"multi-byte text", []string{"§§"}, []string{"héllo wörld ", "§", "§ rest"}, "héllo wörld ", true},
+		{"stop longer than text", []string{"a very long stop sequence"}, []string{"ab", "c"}, "abc", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, stopped := runStopFilter(tt.stops, tt.chunks...)
+			if got != tt.want || stopped != tt.stopped {
+				t.Errorf("got %q, %v; want %q, %v", got, stopped, tt.want, tt.stopped)
+			}
+		})
+	}
+}
+
+func TestChatCompletionsStop(t *testing.T) {
+	stubLLM(t, replyWith("one, two", ", thr", "ee, four"))
+	for _, stop := range []string{`"three"`, `["four", "three"]`} {
+		var resp ChatResponse
+		body := `{"messages":[{"role":"user","content":"count"}],"stop":` + stop + `}`
+		if err := json.Unmarshal(serve(handleChatCompletions, newTestRequest("POST", "/v1/chat/completions", strings.NewReader(body))).Body.Bytes(), &resp); err != nil {
+			t.Fatal(err)
+		}
+		if got := resp.Choices[0].Message.Content; got != "one, two, " {
+			t.Errorf("stop %s: content %q, want %q", stop, got, "one, two, ")
+		}
+	}
+
+	var streamed strings.Builder
+	for _, c := range streamCompletion(t, `{"messages":[{"role":"user","content":"count"}],"stream":true,"stop":["three"]}`) {
+		streamed.WriteString(c.Choices[0].Delta["content"])
+	}
+	if streamed.String() != "one, two, " {
+		t.Errorf("streamed %q, want %q", streamed.String(), "one, two, ")
+	}
+}
+
+func TestChatCompletionsChoices(t *testing.T) {
+	stubLLM(t, replyWith("answer"))
+	for _, tt := range []struct{ n, want int }{{0, 1}, {1, 1}, {3, 3}, {maxChoices + 5, maxChoices}} {
+		body := fmt.Sprintf(`{"messages":[{"role":"user","content":"hi"}],"n":%d}`, tt.n)
+		var resp ChatResponse
+		if err := json.Unmarshal(serve(handleChatCompletions, newTestRequest("POST", "/v1/chat/completions", strings.NewReader(body))).Body.Bytes(), &resp); err != nil {
+			t.Fatal(err)
+		}
+		if len(resp.Choices) != tt.want {
+			t.Errorf("n=%d: %d choices, want %d", tt.n, len(resp.Choices), tt.want)
+		}
+		for i, c := range resp.Choices {
+			if c.Index != i || c.Message.Content != "answer" {
+				t.Errorf("n=%d: choice %d = %+v", tt.n, i, c)
+			}
+		}
+	}
+}
+
+func TestChatCompletionsStreamedChoices(t *testing.T) {
+	stubLLM(t, replyWith("a", "b"))
+	finished := make(map[int]bool)
+	content := make(map[int]string)
+	for _, c := range streamCompletion(t, `{"messages":[{"role":"user","content":"hi"}],"stream":true,"n":3}`) {
+		choice := c.Choices[0]
+		content[choice.Index] += choice.Delta["content"]
+		if choice.FinishReason != nil {
+			finished[choice.Index] = true
+		}
+	}
+	for i := 0; i < 3; i++ {
+		if content[i] != "ab" || !finished[i] {
+			t.Errorf("choice %d: content %q, finished %v", i, content[i], finished[i])
+		}
+	}
+	if len(content) != 3 {
+		t.Errorf("indices %v, want 0, 1 and 2", content)
+	}
+}
+
+// countFlushes counts calls to Flush
+type countFlushes struct{ n int }
+
+func (f *countFlushes) Flush() { f.n++ }
+
+func TestHeartbeatWhileWaiting(t *testing.T) {
+	ch := make(chan string, 1)
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		ch <- "first"
+	}()
+	var out strings.Builder
+	flusher := &countFlushes{}
+	v, ok := waitWithHeartbeat(&out, flusher, ch, 10*time.Millisecond)
+	if !ok || v != "first" {
+		t.Fatalf("waitWithHeartbeat = %q, %v; want the first value", v, ok)
+	}
+	beats := strings.Count(out.String(), ": keep-alive\n\n")
+	if beats < 2 || out.String() != strings.Repeat(": keep-alive\n\n", beats) {
+		t.Errorf("wrote %q while waiting, want several keep-alive comments", out.String())
+	}
+	if flusher.n != beats {
+		t.Errorf("flushed %d times for %d heartbeats", flusher.n, beats)
+	}
+}
+
+func TestHeartbeatNotNeeded(t *testing.T) {
+	ch := make(chan string, 1)
+	ch <- "ready"
+	var out strings.Builder
+	if v, ok := waitWithHeartbeat(&out, noFlush{}, ch, time.Millisecond); !ok || v != "ready" || out.Len() != 0 {
+		t.Errorf("waitWithHeartbeat = %q, %v and wrote %q; want the value and no heartbeat", v, ok, out.String())
+	}
+
+	closed := make(chan string)
+	close(closed)
+	if _, ok := waitWithHeartbeat(&out, noFlush{}, closed, time.Millisecond); ok {
+		t.Error("ok for a closed channel")
+	}
+}
+
+func TestRootStreamHeartbeatThenContent(t *testing.T) {
+	if testing.Short() {
+		t.Skip("waits out a heartbeat interval")
+	}
+	stubLLM(t, slowReply(sseHeartbeat+sseHeartbeat/5, "pass"))
+	r := newTestRequest("GET", "/?q=pass", nil)
+	r.Header.Set("Accept", "text/event-stream")
+	body := serve(handleRoot, r).Body.String()
+	beat := strings.Index(body, ": keep-alive\n\n")
+	content := strings.Index(body, "data: ")
+	if beat < 0 || content < 0 || beat > content {
+		t.Errorf("body %q, want a heartbeat before the first data event", body)
+	}
+}
+
+const firefoxUA = "Mozilla/5.0 (X11; Linux x86_64; rv:128.0) Gecko/20100101 Firefox/128.0"
+
+// hideFlush wraps a ResponseWriter without its Flush method, like
+// middleware that doesn't pass it on
+type hideFlush struct{ http.ResponseWriter }
+
+func TestStreamsWithoutFlusher(t *testing.T) {
+	stubLLM(t, replyWith("part one ", "part two"))
+	for _, tt := range []struct {
+		name, path, body, accept, ua string
+		want                         string
+	}{
+		{"web page", "/?q=hi", "", "", firefoxUA, "part one part two"},
+		{"command line", "/?q=hi", "", "", "curl/8.4.0", "A: part one part two"},
+		{"sse", "/?q=hi", "", "text/event-stream", "", "data: part two"},
+		{"ndjson", "/?q=hi", "", "application/x-ndjson", "", `"answer":"part one part two"`},
+		{"api", "/v1/chat/completions", `{"messages":[{"role":"user","content":"hi"}],"stream":true}`, "", "", "data: [DONE]"},
+	} {
+		method, h := "GET", http.HandlerFunc(handleRoot)
+		if tt.body != "" {
+			method, h = "POST", handleChatCompletions
+		}
+		r := newTestRequest(method, tt.path, strings.NewReader(tt.body))
+		r.Header.Set("Accept", tt.accept)
+		r.Header.Set("User-Agent", tt.ua)
+		w := httptest.NewRecorder()
+		h(hideFlush{w}, r)
+		if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), tt.want) {
+			t.Errorf("%s: status %d, body %q lacks %q", tt.name, w.Code, w.Body.String(), tt.want)
+		}
+	}
+}
+
+func TestIsCLIUA(t *testing.T) {
+	for ua, want := range map[string]bool{
+		"curl/8.4.0":                   true,
+		"curl/7.68.0":                  true,
+		"curl":                         true,
+		"Curl/8.4.0":                   true,
+		"Wget/1.21.4":                  true,
+		"HTTPie/3.2.2":                 true,
+		"xh/0.22.0":                    true,
+		"aria2/1.37.0":                 true,
+		"fetch libfetch/2.0":           true,
+		"  curl/8.4.0":                 true,
+		"":                             false,
+		firefoxUA:                      false,
+		"python-requests/2.31.0":       false,
+		"curlew/1.0":                   false,
+		"Mozilla/5.0 curl/8.4.0":       false,
+		"Go-http-client/1.1":           false,
+		"libcurl-agent/1.0 curl/8.4.0": false,
+	} {
+		if got := isCLIUA(ua); got != want {
+			t.Errorf("isCLIUA(%q) = %v, want %v", ua, got, want)
+		}
+	}
+}
+
+func TestNegotiate(t *testing.T) {
+	for _, tt := range []struct {
+		target, accept, ua string
+		want               responseMode
+	}{
+		{"/", "", "", modeText},
+		{"/", "*/*", "", modeText},
+		{"/", "application/json", "", modeJSON},
+		{"/", "text/event-stream", "", modeSSE},
+		{"/", "application/x-ndjson", "", modeNDJSON},
+		{"/", "text/html,application/xhtml+xml,*/*;q=0.8", firefoxUA, modeHTML},
+		{"/", "", firefoxUA, modeHTML},
+		{"/", "*/*", firefoxUA, modeHTML},
+		// A browser asking for JSON gets it
+		{"/", "application/json", firefoxUA, modeJSON},
+		// Highest q-value wins; ties go to the first listed
+		{"/", "text/html;q=0.5, application/json;q=0.9", firefoxUA, modeJSON},
+		{"/", "application/json;q=0.2, text/event-stream", "", modeSSE},
+		{"/", "text/html, application/json", "", modeHTML},
+		{"/", "application/json, text/html", "", modeJSON},
+		{"/", "APPLICATION/JSON ; q=1", "", modeJSON},
+		// q=0 means not acceptable
+		{"/", "application/json;q=0", "", modeText},
+		{"/", "text/plain", "", modeText},
+		// curl streams plain text with its default Accept, or none at all...
+		{"/", "*/*", "curl/8.4.0", modeCLI},
+		{"/", "", "curl/8.4.0", modeCLI},
+		{"/", "text/plain", "curl/8.4.0", modeCLI},
+		{"/", "text/*;q=0.9, */*;q=0.1", "Wget/1.21.4", modeCLI},
+		// ...but a more specific Accept wins over the user agent
+		{"/", "application/json", "curl/8.4.0", modeJSON},
+		{"/", "text/event-stream", "curl/8.4.0", modeSSE},
+		{"/", "application/x-ndjson", "curl/8.4.0", modeNDJSON},
+		{"/", "text/html", "curl/8.4.0", modeHTML},
+		{"/", "*/*, image/png", "curl/8.4.0", modeText},
+		{"/?format=text", "*/*", "curl/8.4.0", modeText},
+		// ?format= overrides everything
+		{"/?format=json", "text/html", firefoxUA, modeJSON},
+		{"/?format=text", "application/json", "", modeText},
+		{"/?format=html", "", "", modeHTML},
+		{"/?format=stream", "", "", modeSSE},
+		{"/?format=ndjson", "", "", modeNDJSON},
+	} {
+		r := httptest.NewRequest("GET", tt.target, nil)
+		if tt.accept != "" {
+			r.Header.Set("Accept", tt.accept)
+		}
+		if tt.ua != "" {
+			r.Header.Set("User-Agent", tt.ua)
+		}
+		if got, err := negotiate(r); err != nil || got != tt.want {
+			t.Errorf("%s with Accept %q, User-Agent %q: got %v, %v; want %v", tt.target, tt.accept, tt.ua, got, err, tt.want)
+		}
+	}
+}
+
+func TestNegotiateRejectsUnknownFormat(t *testing.T) {
+	if _, err := negotiate(httptest.NewRequest("GET", "/?format=xml", nil)); err == nil {
+		t.Error("format=xml accepted")
+	}
+}
+
+func TestRootFormats(t *testing.T) {
+	for _, tt := range []struct {
+		format, contentType string
+		check               func(body string) bool
+	}{
+		{"json", "application/json", func(body string) bool {
+			var got map[string]string
+			return json.Unmarshal([]byte(body), &got) == nil && got["question"] == "hi" && got["answer"] == "pass"
+		}},
+		{"text", "text/plain", func(body string) bool { return body == "Q: hi\nA: pass\n\n" }},
+		{"html", "text/html", func(body string) bool {
+			return strings.HasPrefix(body, "<!DOCTYPE html>") && strings.Contains(body, "pass")
+		}},
+		{"stream", "text/event-stream", func(body string) bool {
+			events := parseSSE(body)
+			return len(events) > 1 && strings.Contains(body, "data: pass\n") && events[len(events)-1].data == "[DONE]"
+		}},
+		{"ndjson", "application/x-ndjson", func(body string) bool {
+			lines := strings.Split(strings.TrimSuffix(body, "\n"), "\n")
+			var last map[string]interface{}
+			return json.Unmarshal([]byte(lines[len(lines)-1]), &last) == nil && last["answer"] == "pass" && last["done"] == true
+		}},
+	} {
+		stubLLM(t, replyWith("pa", "ss"))
+		w := serve(handleRoot, newTestRequest("GET", "/?q=hi&format="+tt.format, nil))
+		if w.Code != http.StatusOK || !strings.HasPrefix(w.Header().Get("Content-Type"), tt.contentType) {
+			t.Errorf("format=%s: status %d, Content-Type %q; want 200 and %s", tt.format, w.Code, w.Header().Get("Content-Type"), tt.contentType)
+		}
+		if !tt.check(w.Body.String()) {
+			t.Errorf("format=%s: unexpected body %q", tt.format, w.Body.String())
+		}
+	}
+}
+
+func TestRootContentLength(t *testing.T) {
+	for _, ttl := range []time.Duration{0, time.Minute} {
+		useCache(t, ttl)
+		for format, sized := range map[string]bool{"json": true, "text": true, "stream": false, "ndjson": false} {
+			stubLLM(t, replyWith("pa", "ss"))
+			w := serve(handleRoot, newTestRequest("GET", "/?q=hi&format="+format, nil))
+			length := w.Header().Get("Content-Length")
+			if !sized {
+				if length != "" {
+					t.Errorf("cache ttl %s, format=%s: streamed with Content-Length %s", ttl, format, length)
+				}
+				continue
+			}
+			if want := strconv.Itoa(w.Body.Len()); length != want {
+				t.Errorf("cache ttl %s, format=%s: Content-Length %q, want %s", ttl, format, length, want)
+			}
+		}
+	}
+}
+
+func TestProxyBufferingHints(t *testing.T) {
+	stubLLM(t, replyWith("pass"))
+	for _, tt := range []struct {
+		name, target, ua, body string
+		streamed               bool
+	}{
+		{"web page", "/?q=hi", firefoxUA, "", true},
+		{"command line", "/?q=hi", "curl/8.4.0", "", true},
+		{"sse", "/?q=hi&format=stream", "", "", true},
+		{"ndjson", "/?q=hi&format=ndjson", "", "", true},
+		{"text", "/?q=hi&format=text", "", "", false},
+		{"json", "/?q=hi&format=json", "", "", false},
+		{"api stream", "/v1/chat/completions", "", `{"messages":[{"role":"user","content":"hi"}],"stream":true}`, true},
+		{"api", "/v1/chat/completions", "", `{"messages":[{"role":"user","content":"hi"}]}`, false},
+	} {
+		method, h := "GET", http.HandlerFunc(handleRoot)
+		if tt.body != "" {
+			method, h = "POST", handleChatCompletions
+		}
+		r := newTestRequest(method, tt.target, strings.NewReader(tt.body))
+		r.Header.Set("User-Agent", tt.ua)
+		got := serve(h, r).Header().Get("X-Accel-Buffering")
+		if want := tt.streamed && proxyBufferingHints; (got == "no") != want {
+			t.Errorf("%s: X-Accel-Buffering %q, want it set: %v", tt.name, got, want)
+		}
+	}
+}
+
+func TestEarlyFlushPadding(t *testing.T) {
+	for _, tt := range []struct {
+		size, target, want int
+	}{
+		{1000, 6144, (6144 - 1000) / 3},
+		{6143, 6144, 0}, // Less than one zero-width space short
+		{6144, 6144, 0},
+		{8000, 6144, 0},
+		{1000, 0, 0}, // Padding off
+	} {
+		padding := earlyFlushPadding(tt.size, tt.target)
+		if n := utf8.RuneCountInString(padding); n != tt.want || strings.Trim(padding, "\u200B") != "" {
+			t.Errorf("earlyFlushPadding(%d, %d): %d runes (%q), want %d zero-width spaces", tt.size, tt.target, n, padding, tt.want)
+		}
+	}
+
+	// A short page starts with the padding when it's configured
+	stubLLM(t, replyWith("pass"))
+	r := newTestRequest("GET", "/?q=hi", nil)
+	r.Header.Set("User-Agent", firefoxUA)
+	body := serve(handleRoot, r).Body.String()
+	if padded := strings.Contains(body, htmlHeader+"\u200B"); padded != (earlyFlushBytes > len(htmlHeader)+3) {
+		t.Errorf("web page padded: %v, with earlyFlushBytes %d", padded, earlyFlushBytes)
+	}
+}
+
+func TestRootRangeOfCachedAnswer(t *testing.T) {
+	useCache(t, time.Minute)
+	stubLLM(t, replyWith("0123456789", "abcdef"))
+	get := func(rangeHeader string) *httptest.ResponseRecorder {
+		r := newTestRequest("GET", "/?q=range&format=text", nil)
+		if rangeHeader != "" {
+			r.Header.Set("Range", rangeHeader)
+		}
+		return serve(handleRoot, r)
+	}
+
+	whole := get("")
+	if whole.Code != http.StatusOK || whole.Header().Get("Accept-Ranges") != "bytes" {
+		t.Fatalf("whole answer: status %d, Accept-Ranges %q", whole.Code, whole.Header().Get("Accept-Ranges"))
+	}
+	full := whole.Body.String()
+
+	w := get("bytes=3-9")
+	if want := fmt.Sprintf("bytes 3-9/%d", len(full)); w.Code != http.StatusPartialContent || w.Header().Get("Content-Range") != want {
+		t.Errorf("bytes=3-9: status %d, Content-Range %q, want 206 and %q", w.Code, w.Header().Get("Content-Range"), want)
+	}
+	if w.Body.String() != full[3:10] {
+		t.Errorf("bytes=3-9: body %q, want %q", w.Body.String(), full[3:10])
+	}
+
+	// Resuming from an offset gets the rest
+	if w := get(fmt.Sprintf("bytes=%d-", len(full)-6)); w.Code != http.StatusPartialContent || w.Body.String() != full[len(full)-6:] {
+		t.Errorf("open range: status %d, body %q", w.Code, w.Body.String())
+	}
+
+	if w := get(fmt.Sprintf("bytes=%d-", len(full)+10)); w.Code != http.StatusRequestedRangeNotSatisfiable {
+		t.Errorf("range past the end: status %d, want 416", w.Code)
+	}
+
+	// Without the cache the next answer may differ, so Range is ignored
+	useCache(t, 0)
+	if w := get("bytes=3-9"); w.Code != http.StatusOK || w.Body.String() != full {
+		t.Errorf("uncached: status %d, body %q, want the whole answer", w.Code, w.Body.String())
+	}
+}
+
+func TestRootRejectsUnknownFormat(t *testing.T) {
+	stubLLM(t, failWith(errors.New("backend called for a rejected request")))
+	if w := serve(handleRoot, newTestRequest("GET", "/?q=hi&format=xml", nil)); w.Code != http.StatusBadRequest {
+		t.Errorf("format=xml: status %d, want 400", w.Code)
+	}
+}
+
+// refuseLLM makes any backend call for the rest of the test an error
+func refuseLLM(t *testing.T) {
+	t.Helper()
+	stubLLM(t, func(ctx context.Context, input interface{}, stream chan<- string) (string, error) {
+		t.Errorf("backend called with %q", promptOf(input))
+		if stream != nil {
+			close(stream)
+		}
+		return "", errors.New("unexpected backend call")
+	})
+}
+
+func TestFaviconAndRobotsSkipLLM(t *testing.T) {
+	refuseLLM(t)
+	mux := newMux()
+	addr := testAddr()
+	// Well past the rate limit's burst, from one client
+	for i := 0; i < 30; i++ {
+		for _, path := range []string{"/favicon.ico", "/robots.txt"} {
+			r := httptest.NewRequest("GET", path, nil)
+			r.RemoteAddr = addr
+			w := httptest.NewRecorder()
+			mux.ServeHTTP(w, r)
+			if w.Code != http.StatusOK && w.Code != http.StatusNoContent {
+				t.Fatalf("request %d for %s: status %d", i, path, w.Code)
+			}
+		}
+	}
+
+	r := httptest.NewRequest("GET", "/robots.txt", nil)
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, r)
+	if w.Body.String() != robotsTxt {
+		t.Errorf("robots.txt = %q, want %q", w.Body.String(), robotsTxt)
+	}
+
+	// The client still has its whole rate-limit budget
+	stubLLM(t, replyWith("pass"))
+	r = httptest.NewRequest("GET", "/?q=hi", nil)
+	r.RemoteAddr = addr
+	w = httptest.NewRecorder()
+	mux.ServeHTTP(w, r)
+	if w.Code != http.StatusOK {
+		t.Errorf("query after favicon and robots requests: status %d", w.Code)
+	}
+}
+
+func TestIsProbePath(t *testing.T) {
+	for _, path := range []string{
+		"/wp-login.php", "/.env", "/.git/config", "/WP-ADMIN/", "/cgi-bin/luci",
+		"/phpmyadmin/index.php", "/backup.sql", "/config.yml", "/site.zip", "/xmlrpc.php",
+	} {
+		if !isProbePath(path) {
+			t.Errorf("isProbePath(%q) = false", path)
+		}
+	}
+	for _, path := range []string{
+		"/", "/what-is-dns", "/how%20do%20i%20use%20php", "/why is the sky blue", "/explain.the.env.var.pattern",
+	} {
+		if isProbePath(path) {
+			t.Errorf("isProbePath(%q) = true", path)
+		}
+	}
+}
+
+func TestRootProbePathNotFound(t *testing.T) {
+	refuseLLM(t)
+	w := serve(handleRoot, newTestRequest("GET", "/wp-login.php", nil))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("status %d, want 404", w.Code)
+	}
+}
+
+func TestRootPathQueryAnswers(t *testing.T) {
+	var asked string
+	stubLLM(t, func(ctx context.Context, input interface{}, stream chan<- string) (string, error) {
+		asked = promptOf(input)
+		return replyWith("pass")(ctx, input, stream)
+	})
+	w := serve(handleRoot, newTestRequest("GET", "/what-is-dns", nil))
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "pass") {
+		t.Errorf("status %d, body %q; want an answer", w.Code, w.Body.String())
+	}
+	if !strings.Contains(asked, "what is dns") {
+		t.Errorf("backend asked %q, want the path as a question", asked)
+	}
+}
+
+func TestRootRawMode(t *testing.T) {
+	useCache(t, 0)
+	prompts := make(chan string, 1)
+	stubLLM(t, func(ctx context.Context, input interface{}, stream chan<- string) (string, error) {
+		prompts <- promptOf(input)
+		return replyWith("<b>4</b>")(ctx, input, stream)
+	})
+	const question = "what is 2+2"
+	for _, ua := range []string{"curl/8.4.0", firefoxUA} {
+		for _, raw := range []string{"", "1"} {
+			// With lang there are instructions to skip even for plain text
+			r := newTestRequest("GET", "/?q="+url.QueryEscape(question)+"&lang=de&raw="+raw, nil)
+			r.Header.Set("User-Agent", ua)
+			body := serve(handleRoot, r).Body.String()
+			if got := <-prompts; (got == question) != (raw == "1") {
+				t.Errorf("%s, raw=%q: backend asked %q", ua, raw, got)
+			}
+			// The model's HTML is only trusted when we asked for it
+			if ua == firefoxUA && raw == "1" && (strings.Contains(body, "<b>4</b>") || !strings.Contains(body, "&lt;b&gt;4&lt;/b&gt;")) {
+				t.Errorf("raw web page doesn't escape the answer: %q", body)
+			}
+		}
+	}
+}
+
+func TestPathQuery(t *testing.T) {
+	for _, tt := range []struct{ path, want string }{
+		{"/", ""},
+		{"//", ""},
+		{"///", ""},
+		{"/index.html", ""},
+		{"/-/", ""},
+		{"/...", ""},
+		{"/what-is-dns", "what is dns"},
+		{"/why is the sky blue", "why is the sky blue"},
+		{"/42", "42"},
+	} {
+		if got := pathQuery(tt.path); got != tt.want {
+			t.Errorf("pathQuery(%q) = %q, want %q", tt.path, got, tt.want)
+		}
+	}
+}
+
+func TestRootEmptyPathsShowForm(t *testing.T) {
+	refuseLLM(t)
+	for _, path := range []string{"/", "//", "/index.html"} {
+		r := newTestRequest("GET", path, nil)
+		r.Header.Set("User-Agent", firefoxUA)
+		w := serve(handleRoot, r)
+		if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "<form") {
+			t.Errorf("%s: status %d, want the chat form", path, w.Code)
+		}
+	}
+}
+
+func TestNewServerTimeouts(t *testing.T) {
+	s := newServer(":8080", http.NotFoundHandler())
+	if s.Addr != ":8080" || s.Handler == nil {
+		t.Errorf("addr %q, handler %v", s.Addr, s.Handler)
+	}
+	for _, tt := range []struct {
+		name      string
+		got, want time.Duration
+	}{
+		{"ReadHeaderTimeout", s.ReadHeaderTimeout, readHeaderTimeout},
+		{"ReadTimeout", s.ReadTimeout, readTimeout},
+		{"WriteTimeout", s.WriteTimeout, writeTimeout},
+		{"IdleTimeout", s.IdleTimeout, idleTimeout},
+	} {
+		if tt.got != tt.want || tt.got <= 0 {
+			t.Errorf("%s = %s, want %s", tt.name, tt.got, tt.want)
+		}
+	}
+	// A stream may run for llmTimeout, so writes must not be cut off first
+	if s.WriteTimeout <= llmTimeout {
+		t.Errorf("WriteTimeout %s doesn't outlast a stream of %s", s.WriteTimeout, llmTimeout)
+	}
+}
+
+func TestHTTPSOnlyServesAPI(t *testing.T) {
+	stubLLM(t, replyWith("pass"))
+	// The mux is all the HTTPS listener gets; nothing else is registered
+	srv := httptest.NewTLSServer(newMux())
+	defer srv.Close()
+
+	resp, err := srv.Client().Post(srv.URL+"/v1/chat/completions", "application/json",
+		strings.NewReader(`{"messages":[{"role":"user","content":"repeat pass"}]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var got ChatResponse
+	if err := json.NewDecoder(resp.Body).Decode(&got); err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatalf("status %d, decode error %v", resp.StatusCode, err)
+	}
+	if len(got.Choices) != 1 || got.Choices[0].Message.Content != "pass" {
+		t.Errorf("choices %+v, want one answering pass", got.Choices)
+	}
+}
+
+func TestHTTPSHost(t *testing.T) {
+	for _, tt := range []struct {
+		host string
+		port int
+		want string
+	}{
+		{"ch.at", 443, "ch.at"},
+		{"ch.at:80", 443, "ch.at"},
+		{"ch.at:8080", 8443, "ch.at:8443"},
+		{"127.0.0.1:8080", 443, "127.0.0.1"},
+		{"[::1]:8080", 443, "[::1]"},
+		{"[::1]:8080", 8443, "[::1]:8443"},
+		{"[::1]", 443, "[::1]"},
+		{"[::1]", 8443, "[::1]:8443"},
+	} {
+		if got := httpsHost(tt.host, tt.port); got != tt.want {
+			t.Errorf("httpsHost(%q, %d) = %q, want %q", tt.host, tt.port, got, tt.want)
+		}
+	}
+}
+
+func TestRedirectBrowsers(t *testing.T) {
+	var served []string
+	h := redirectBrowsers(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		served = append(served, r.Method+" "+r.Header.Get("User-Agent"))
+	}))
+
+	for _, host := range []string{"ch.at", "[::1]"} {
+		r := httptest.NewRequest("GET", "/?q=what+is+dns", nil)
+		r.Host = host
+		r.Header.Set("User-Agent", firefoxUA)
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		want := "https://" + httpsHost(host, HTTPS_PORT) + "/?q=what+is+dns"
+		if w.Code != http.StatusMovedPermanently || w.Header().Get("Location") != want {
+			t.Errorf("browser GET to %s: status %d to %q, want 301 to %q", host, w.Code, w.Header().Get("Location"), want)
+		}
+	}
+	if len(served) != 0 {
+		t.Fatalf("browser GETs answered over plain HTTP: %v", served)
+	}
+
+	for _, req := range []struct{ method, ua string }{
+		{"GET", "curl/8.4.0"},
+		{"GET", ""},
+		{"POST", firefoxUA},
+	} {
+		r := httptest.NewRequest(req.method, "/?q=hi", nil)
+		r.Header.Set("User-Agent", req.ua)
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		if w.Code == http.StatusMovedPermanently {
+			t.Errorf("%s from %q redirected", req.method, req.ua)
+		}
+	}
+	if len(served) != 3 {
+		t.Errorf("served %v, want curl, no user agent and the browser POST", served)
+	}
+}
+
+func TestValidRequestID(t *testing.T) {
+	for id, want := range map[string]bool{
+		"abc-123_X.y":           true,
+		strings.Repeat("a", 64): true,
+		"":                      false,
+		strings.Repeat("a", 65): false,
+		"has space":             false,
+		"new\nline":             false,
+		"ünïcode":               false,
+	} {
+		if got := validRequestID(id); got != want {
+			t.Errorf("validRequestID(%q) = %v, want %v", id, got, want)
+		}
+	}
+}
+
+func TestRequestIDHeader(t *testing.T) {
+	var seen string
+	h := tagRequests(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		seen = requestID(r.Context())
+	}))
+
+	for _, tt := range []struct {
+		sent  string
+		keeps bool
+	}{
+		{"trace-42", true},
+		{"", false},
+		{"not valid!", false},
+	} {
+		r := httptest.NewRequest("GET", "/", nil)
+		if tt.sent != "" {
+			r.Header.Set("X-Request-ID", tt.sent)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		got := w.Header().Get("X-Request-ID")
+		if got != seen {
+			t.Errorf("sent %q: header %q but context %q", tt.sent, got, seen)
+		}
+		if tt.keeps && got != tt.sent {
+			t.Errorf("sent %q: got %q back", tt.sent, got)
+		}
+		if !tt.keeps && (got == tt.sent || len(got) != 24 || !validRequestID(got)) {
+			t.Errorf("sent %q: got %q, want a fresh 24-character id", tt.sent, got)
+		}
+	}
+}
+
+func TestRequestIDInCompletionID(t *testing.T) {
+	stubLLM(t, replyWith("pass"))
+	r := newTestRequest("POST", "/v1/chat/completions", strings.NewReader(`{"messages":[{"role":"user","content":"hi"}]}`))
+	r.Header.Set("X-Request-ID", "trace-42")
+	w := httptest.NewRecorder()
+	newMux().ServeHTTP(w, r)
+	var got ChatResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &got); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(got.ID, "chatcmpl-trace-42-") {
+		t.Errorf("id %q, want it to carry the request id", got.ID)
+	}
+}
+
+func TestRootNDJSON(t *testing.T) {
+	// Chunks with characters JSON must escape
+	chunks := []string{"Line one\n", `"quoted" `, "<tag> & ", "ünïcode"}
+	stubLLM(t, replyWith(chunks...))
+	r := newTestRequest("GET", "/?q=hi", nil)
+	r.Header.Set("Accept", "application/x-ndjson")
+	w := serve(handleRoot, r)
+	if ct := w.Header().Get("Content-Type"); ct != "application/x-ndjson" {
+		t.Errorf("Content-Type %q", ct)
+	}
+
+	lines := strings.Split(strings.TrimSuffix(w.Body.String(), "\n"), "\n")
+	var deltas strings.Builder
+	for i, line := range lines {
+		var obj struct {
+			Delta  *string `json:"delta"`
+			Answer *string `json:"answer"`
+			Done   bool    `json:"done"`
+		}
+		if err := json.Unmarshal([]byte(line), &obj); err != nil {
+			t.Fatalf("line %d %q is not JSON: %v", i, line, err)
+		}
+		if i < len(lines)-1 {
+			if obj.Delta == nil || obj.Done {
+				t.Errorf("line %d %q, want a delta", i, line)
+			} else {
+				deltas.WriteString(*obj.Delta)
+			}
+			continue
+		}
+		if !obj.Done || obj.Answer == nil || *obj.Answer != strings.Join(chunks, "") {
+			t.Errorf("last line %q, want done with the full answer", line)
+		}
+	}
+	if deltas.String() != strings.Join(chunks, "") {
+		t.Errorf("deltas add up to %q", deltas.String())
+	}
+}
+
+func TestTrimAnswerLabel(t *testing.T) {
+	for reply, want := range map[string]string{
+		"A: Paris":            "Paris",
+		"  \nA:Paris":         "Paris",
+		"Q: what else?":       "what else?",
+		"Paris":               "Paris",
+		"  Paris":             "  Paris",
+		"As you know, Paris":  "As you know, Paris",
+		"Paris.\nA: and more": "Paris.\nA: and more",
+		"":                    "",
+	} {
+		if got := trimAnswerLabel(reply); got != want {
+			t.Errorf("trimAnswerLabel(%q) = %q, want %q", reply, got, want)
+		}
+	}
+}
+
+// runLabelFilter passes chunks through a labelFilter and returns its output
+func runLabelFilter(chunks ...string) string {
+	var f labelFilter
+	var out strings.Builder
+	for _, chunk := range chunks {
+		out.WriteString(f.Write(chunk))
+	}
+	out.WriteString(f.Flush())
+	return out.String()
+}
+
+func TestLabelFilter(t *testing.T) {
+	for _, tt := range []struct {
+		chunks []string
+		want   string
+	}{
+		{[]string{"A: Paris"}, "Paris"},
+		{[]string{"A", ":", " ", "Par", "is"}, "Paris"},
+		{[]string{" ", "\n", "Q:", " hi"}, "hi"},
+		{[]string{"Paris", " is the capital"}, "Paris is the capital"},
+		{[]string{"As", " you know"}, "As you know"},
+		{[]string{"A"}, "A"},
+		{[]string{"Ok", ". A: not a label"}, "Ok. A: not a label"},
+	} {
+		if got := runLabelFilter(tt.chunks...); got != tt.want {
+			t.Errorf("chunks %q: got %q, want %q", tt.chunks, got, tt.want)
+		}
+	}
+}
+
+func TestRootStripsEchoedLabel(t *testing.T) {
+	stubLLM(t, replyWith("A", ": ", "Paris"))
+	w := serve(handleRoot, newTestRequest("GET", "/?q=capital+of+france", nil))
+	if got, want := w.Body.String(), "Q: capital of france\nA: Paris\n\n"; got != want {
+		t.Errorf("transcript %q, want %q", got, want)
+	}
+
+	stubLLM(t, replyWith("A", ": ", "Paris"))
+	r := newTestRequest("GET", "/?q=capital+of+france", nil)
+	r.Header.Set("Accept", "text/event-stream")
+	if body := serve(handleRoot, r).Body.String(); strings.Contains(body, "A:") || !strings.Contains(body, "Paris") {
+		t.Errorf("stream %q, want Paris without the label", body)
+	}
+}
+
+// trickyHistory has questions and answers that look like transcript labels
+var trickyHistory = []exchange{
+	{Question: "What does\nQ: mean in a transcript?", Answer: "It marks a question.\nA: marks an <b>answer</b>."},
+	{Question: "A: is this a question?", Answer: "Yes & no.\n\nQ: and A: are just text here."},
+}
+
+func TestHistoryRoundTrip(t *testing.T) {
+	encoded := encodeHistory(trickyHistory)
+	if strings.Contains(encoded, `\u003c`) || strings.Contains(encoded, `\u0026`) || !strings.Contains(encoded, "<b>answer</b>") {
+		t.Errorf("encodeHistory escaped HTML: %s", encoded)
+	}
+	got := parseHistory(encoded)
+	if len(got) != len(trickyHistory) || got[0] != trickyHistory[0] || got[1] != trickyHistory[1] {
+		t.Errorf("parseHistory(encodeHistory(h)) = %q, want %q", got, trickyHistory)
+	}
+	if encodeHistory(nil) != "" || parseHistory("") != nil {
+		t.Error("empty history not encoded as empty")
+	}
+}
+
+func TestParseHistoryTranscript(t *testing.T) {
+	got := parseHistory("Q: first\nA: one\n\nQ: second\nA: two\nlines\n\n")
+	want := []exchange{{"first", "one"}, {"second", "two\nlines"}}
+	if len(got) != 2 || got[0] != want[0] || got[1] != want[1] {
+		t.Errorf("parseHistory = %q, want %q", got, want)
+	}
+}
+
+func TestLimitHistory(t *testing.T) {
+	// More turns than allowed, each small: the oldest ones go
+	var history []exchange
+	for i := range maxHistoryTurns + 5 {
+		history = append(history, exchange{Question: fmt.Sprintf("q%d", i), Answer: "a"})
+	}
+	got := limitHistory(history)
+	if len(got) != maxHistoryTurns || got[0].Question != "q5" || got[len(got)-1] != history[len(history)-1] {
+		t.Errorf("%d turns kept, from %q; want the last %d", len(got), got[0].Question, maxHistoryTurns)
+	}
+
+	// Few turns, but too long together: the byte cap drops more
+	big := strings.Repeat("x", maxHistoryBytes/4)
+	history = []exchange{{"old", big}, {"older", big}, {"recent", big}, {"latest", big}}
+	got = limitHistory(history)
+	if len(got) != 3 || got[0].Question != "older" || len(transcript(got)) > maxHistoryBytes {
+		t.Errorf("kept %d turns of %d bytes, want the last 3", len(got), len(transcript(got)))
+	}
+
+	if got := limitHistory(history[:1]); len(got) != 1 {
+		t.Errorf("history within both caps cut to %d turns", len(got))
+	}
+}
+
+func TestRootHistoryTurnLimit(t *testing.T) {
+	useCache(t, 0)
+	prompts := make(chan string, 1)
+	stubLLM(t, func(ctx context.Context, input interface{}, stream chan<- string) (string, error) {
+		prompts <- promptOf(input)
+		return replyWith("ok")(ctx, input, stream)
+	})
+	var history []exchange
+	for i := range maxHistoryTurns + 1 {
+		history = append(history, exchange{Question: fmt.Sprintf("turn-%d?", i), Answer: "ok"})
+	}
+	form := url.Values{"q": {"next"}, "h": {encodeHistory(history)}}
+	r := newTestRequest("POST", "/?format=text", strings.NewReader(form.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	serve(handleRoot, r)
+	prompt := <-prompts
+	if strings.Contains(prompt, "turn-0?") || !strings.Contains(prompt, "turn-1?") || !strings.Contains(prompt, fmt.Sprintf("turn-%d?", maxHistoryTurns)) {
+		t.Errorf("prompt %q, want every turn but the oldest", prompt)
+	}
+}
+
+// formHistoryField is the history carried in a web page's hidden field
+var formHistoryField = regexp.MustCompile(`(?s)<textarea name="h"[^>]*>(.*?)</textarea>`)
+
+func TestWebHistorySurvivesLabels(t *testing.T) {
+	stubLLM(t, replyWith("Q: sure.\nA: done"))
+	form := url.Values{"q": {"and Q: then?"}, "h": {encodeHistory(trickyHistory)}}
+	r := newTestRequest("POST", "/", strings.NewReader(form.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	r.Header.Set("User-Agent", firefoxUA)
+	body := serve(handleRoot, r).Body.String()
+
+	m := formHistoryField.FindStringSubmatch(body)
+	if m == nil {
+		t.Fatalf("no history field in %q", body)
+	}
+	got := parseHistory(html.UnescapeString(m[1]))
+	if len(got) != 3 || got[0] != trickyHistory[0] || got[1] != trickyHistory[1] || got[2].Question != "and Q: then?" {
+		t.Errorf("history after one more question: %q", got)
+	}
+	if n := strings.Count(body, `<div class="q">`); n != 3 {
+		t.Errorf("%d questions rendered, want 3", n)
+	}
+}
+
+// oversizedChat is a chat request body just over maxAPIBody
+func oversizedChat() string {
+	return `{"messages":[{"role":"user","content":"` + strings.Repeat("a", maxAPIBody) + `"}]}`
+}
+
+// useEmbeddings makes fn the backend's embeddings, with embed-1 as their
+// default model, for the rest of the test
+func useEmbeddings(t *testing.T, fn func(ctx context.Context, model string, input []string) ([][]float64, int, error)) {
+	t.Helper()
+	old, oldModel := llmEmbed, llmEmbeddingModel
+	llmEmbed, llmEmbeddingModel = fn, "embed-1"
+	t.Cleanup(func() { llmEmbed, llmEmbeddingModel = old, oldModel })
+}
+
+func TestAPIRejectsOversizedBody(t *testing.T) {
+	refuseLLM(t)
+	useEmbeddings(t, func(ctx context.Context, model string, input []string) ([][]float64, int, error) {
+		t.Error("embeddings computed for an oversized body")
+		return nil, 0, errors.New("unexpected call")
+	})
+	for _, tt := range []struct {
+		h    http.HandlerFunc
+		path string
+		body string
+	}{
+		{handleChatCompletions, "/v1/chat/completions", oversizedChat()},
+		{handleEmbeddings, "/v1/embeddings", `{"input":"` + strings.Repeat("a", maxAPIBody) + `"}`},
+	} {
+		w := serve(tt.h, newTestRequest("POST", tt.path, strings.NewReader(tt.body)))
+		if w.Code != http.StatusRequestEntityTooLarge {
+			t.Errorf("%s: status %d, want 413", tt.path, w.Code)
+			continue
+		}
+		if e := apiError(t, w); e.Code != "request_too_large" || e.Type != "invalid_request_error" {
+			t.Errorf("%s: error %+v", tt.path, e)
+		}
+	}
+}
+
+// fakeEmbeddings is an embeddings backend that gives each input a vector of
+// its length and counts one token per byte
+func fakeEmbeddings(ctx context.Context, model string, input []string) ([][]float64, int, error) {
+	vectors := make([][]float64, len(input))
+	tokens := 0
+	for i, s := range input {
+		vectors[i] = []float64{float64(len(s)), 0.5}
+		tokens += len(s)
+	}
+	return vectors, tokens, nil
+}
+
+func TestEmbeddings(t *testing.T) {
+	useEmbeddings(t, fakeEmbeddings)
+	for _, tt := range []struct {
+		body  string
+		input []string
+	}{
+		{`{"model":"embed-1","input":"hello"}`, []string{"hello"}},
+		{`{"model":"embed-1","input":["a","bb","ccc"]}`, []string{"a", "bb", "ccc"}},
+	} {
+		w := serve(handleEmbeddings, newTestRequest("POST", "/v1/embeddings", strings.NewReader(tt.body)))
+		if w.Code != http.StatusOK {
+			t.Errorf("%s: status %d: %s", tt.body, w.Code, w.Body.String())
+			continue
+		}
+		var resp EmbeddingResponse
+		if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+			t.Fatal(err)
+		}
+		if resp.Object != "list" || resp.Model != "embed-1" || len(resp.Data) != len(tt.input) {
+			t.Errorf("%s: response %+v", tt.body, resp)
+			continue
+		}
+		tokens := 0
+		for i, d := range resp.Data {
+			if d.Object != "embedding" || d.Index != i || len(d.Embedding) != 2 || d.Embedding[0] != float64(len(tt.input[i])) {
+				t.Errorf("%s: data[%d] = %+v", tt.body, i, d)
+			}
+			tokens += len(tt.input[i])
+		}
+		if resp.Usage.PromptTokens != tokens || resp.Usage.TotalTokens != tokens {
+			t.Errorf("%s: usage %+v, want %d tokens", tt.body, resp.Usage, tokens)
+		}
+	}
+}
+
+func TestEmbeddingsModelAllowlist(t *testing.T) {
+	useEmbeddings(t, func(ctx context.Context, model string, input []string) ([][]float64, int, error) {
+		t.Errorf("embeddings computed with model %q", model)
+		return nil, 0, errors.New("unexpected call")
+	})
+	w := serve(handleEmbeddings, newTestRequest("POST", "/v1/embeddings", strings.NewReader(`{"model":"some-expensive-model","input":"hi"}`)))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("unlisted model: status %d, want 400", w.Code)
+	}
+	if e := apiError(t, w); e.Code != "model_not_found" || e.Type != "invalid_request_error" {
+		t.Errorf("unlisted model: error %+v", e)
+	}
+
+	// The default model, by name or left out, and allowlisted ones are fine
+	useEmbeddings(t, fakeEmbeddings)
+	old := allowedModels
+	allowedModels = []string{"embed-2"}
+	t.Cleanup(func() { allowedModels = old })
+	for _, body := range []string{`{"input":"hi"}`, `{"model":"embed-1","input":"hi"}`, `{"model":"embed-2","input":"hi"}`} {
+		if w := serve(handleEmbeddings, newTestRequest("POST", "/v1/embeddings", strings.NewReader(body))); w.Code != http.StatusOK {
+			t.Errorf("%s: status %d: %s", body, w.Code, w.Body.String())
+		}
+	}
+}
+
+func TestEmbeddingsErrors(t *testing.T) {
+	useEmbeddings(t, fakeEmbeddings)
+	for _, body := range []string{`{"input":""}`, `{"input":[]}`, `{"input":["a",""]}`, `{"input":3}`, `{`} {
+		w := serve(handleEmbeddings, newTestRequest("POST", "/v1/embeddings", strings.NewReader(body)))
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("%s: status %d, want 400", body, w.Code)
+			continue
+		}
+		if e := apiError(t, w); e.Type != "invalid_request_error" {
+			t.Errorf("%s: error %+v", body, e)
+		}
+	}
+
+	useEmbeddings(t, func(ctx context.Context, model string, input []string) ([][]float64, int, error) {
+		return [][]float64{{1}}, 1, nil
+	})
+	w := serve(handleEmbeddings, newTestRequest("POST", "/v1/embeddings", strings.NewReader(`{"input":["a","b"]}`)))
+	if w.Code < 500 {
+		t.Errorf("one vector for two inputs: status %d, want a server error", w.Code)
+	}
+
+	useEmbeddings(t, nil)
+	w = serve(handleEmbeddings, newTestRequest("POST", "/v1/embeddings", strings.NewReader(`{"input":"hi"}`)))
+	if w.Code != http.StatusNotImplemented {
+		t.Errorf("no embeddings backend: status %d, want 501", w.Code)
+	} else if e := apiError(t, w); e.Code != "embeddings_unsupported" {
+		t.Errorf("no embeddings backend: error %+v", e)
+	}
+}
+
+func TestChatCompletionsRejectsEmptyPrompts(t *testing.T) {
+	refuseLLM(t)
+	for name, body := range map[string]string{
+		"no messages":        `{}`,
+		"empty messages":     `{"messages":[]}`,
+		"empty content":      `{"messages":[{"role":"user","content":""}]}`,
+		"whitespace content": `{"messages":[{"role":"system","content":" "},{"role":"user","content":"\n\t "}]}`,
+		"unknown role":       `{"messages":[{"role":"wizard","content":"hi"}]}`,
+		"missing role":       `{"messages":[{"content":"hi"}]}`,
+		"unknown later role": `{"messages":[{"role":"user","content":"hi"},{"role":"Assistant","content":"hello"}]}`,
+	} {
+		w := serve(handleChatCompletions, newTestRequest("POST", "/v1/chat/completions", strings.NewReader(body)))
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("%s: status %d, want 400", name, w.Code)
+			continue
+		}
+		if e := apiError(t, w); e.Type != "invalid_request_error" {
+			t.Errorf("%s: error %+v", name, e)
+		}
+	}
+}
+
+func TestValidateMessages(t *testing.T) {
+	ok := []Message{{Role: "system", Content: "be brief"}, {Role: "user", Content: "hi"}, {Role: "assistant", Content: ""}}
+	if err := validateMessages(ok); err != nil {
+		t.Errorf("validateMessages rejected %+v: %v", ok, err)
+	}
+	err := validateMessages([]Message{{Role: "user", Content: "hi"}, {Role: "bot", Content: "hey"}})
+	if err == nil || !strings.Contains(err.Error(), "messages[1]") {
+		t.Errorf("err = %v, want it to point at messages[1]", err)
+	}
+}
+
+func TestRootEmptyQuery(t *testing.T) {
+	refuseLLM(t)
+	for _, tt := range []struct {
+		accept, ua string
+		status     int
+	}{
+		{"text/event-stream", "", http.StatusBadRequest},
+		{"application/x-ndjson", "", http.StatusBadRequest},
+		{"text/event-stream", firefoxUA, http.StatusBadRequest},
+		{"", firefoxUA, http.StatusOK},
+		{"", "", http.StatusOK},
+	} {
+		r := newTestRequest("GET", "/", nil)
+		r.Header.Set("Accept", tt.accept)
+		r.Header.Set("User-Agent", tt.ua)
+		done := make(chan *httptest.ResponseRecorder, 1)
+		go func() { done <- serve(handleRoot, r) }()
+		select {
+		case w := <-done:
+			if w.Code != tt.status {
+				t.Errorf("Accept %q, User-Agent %q: status %d, want %d", tt.accept, tt.ua, w.Code, tt.status)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatalf("Accept %q, User-Agent %q: no response for an empty query", tt.accept, tt.ua)
+		}
+	}
+}
+
+// rootSSE streams the answer to q from handleRoot as server-sent events
+func rootSSE(q string) []sseEvent {
+	r := newTestRequest("GET", "/?q="+url.QueryEscape(q), nil)
+	r.Header.Set("Accept", "text/event-stream")
+	return parseSSE(serve(handleRoot, r).Body.String())
+}
+
+// eventNames lists the event field of each event
+func eventNames(events []sseEvent) []string {
+	var names []string
+	for _, e := range events {
+		names = append(names, e.event)
+	}
+	return names
+}
+
+func TestRootSSEEvents(t *testing.T) {
+	stubLLM(t, replyWith("part one ", "part two"))
+	events := rootSSE("hi")
+	if got, want := eventNames(events), []string{"message", "message", "done"}; !slices.Equal(got, want) {
+		t.Errorf("events %q, want %q", got, want)
+	}
+	if events[len(events)-1].data != "[DONE]" {
+		t.Errorf("done event carries %q", events[len(events)-1].data)
+	}
+
+	stubLLM(t, failWith(errors.New("upstream reset"), "part one "))
+	events = rootSSE("hi")
+	if got, want := eventNames(events), []string{"message", "error", "done"}; !slices.Equal(got, want) {
+		t.Fatalf("events %q, want %q", got, want)
+	}
+	var e struct {
+		Error string `json:"error"`
+	}
+	if err := json.Unmarshal([]byte(events[1].data), &e); err != nil || e.Error == "" {
+		t.Errorf("error event data %q, want a JSON error", events[1].data)
+	}
+}
+
+func TestChatCompletionsStreamErrorEvent(t *testing.T) {
+	stubLLM(t, failWith(errors.New("upstream reset"), "part one "))
+	w := serve(handleChatCompletions, newTestRequest("POST", "/v1/chat/completions",
+		strings.NewReader(`{"messages":[{"role":"user","content":"hi"}],"stream":true}`)))
+	events := parseSSE(w.Body.String())
+	if got, want := eventNames(events), []string{"", "error", ""}; !slices.Equal(got, want) {
+		t.Fatalf("events %q, want a chunk, an error and [DONE]", got)
+	}
+	var e ErrorResponse
+	if err := json.Unmarshal([]byte(events[1].data), &e); err != nil || e.Error.Type != "server_error" || e.Error.Code != "backend_error" {
+		t.Errorf("error event data %q, want an OpenAI-style error", events[1].data)
+	}
+	if events[2].data != "[DONE]" {
+		t.Errorf("stream ends with %q, want [DONE]", events[2].data)
+	}
+}
+
+func TestRootMidStreamErrorNotice(t *testing.T) {
+	for _, tt := range []struct {
+		name, accept, ua string
+		want             []string
+	}{
+		{"web page", "", firefoxUA, []string{`<div class="a">part one part two<p class="error">Error: `}},
+		{"command line", "", "curl/8.4.0", []string{"A: part one part two\n[Error: "}},
+		{"ndjson", "application/x-ndjson", "", []string{`{"delta":"part two"}`, `"answer":"part one part two","done":true,"error":`}},
+	} {
+		stubLLM(t, failWith(errors.New("upstream reset"), "part one ", "part two"))
+		r := newTestRequest("GET", "/?q=hi", nil)
+		r.Header.Set("Accept", tt.accept)
+		r.Header.Set("User-Agent", tt.ua)
+		body := serve(handleRoot, r).Body.String()
+		for _, want := range tt.want {
+			if !strings.Contains(body, want) {
+				t.Errorf("%s: body %q lacks %q", tt.name, body, want)
+			}
+		}
+	}
+}
+
+func TestRootBackendErrorStatus(t *testing.T) {
+	useCache(t, 0)
+	for _, tt := range []struct {
+		err    error
+		status int
+	}{
+		{errors.New("upstream exploded"), http.StatusInternalServerError},
+		{errServerBusy, http.StatusServiceUnavailable},
+		{context.DeadlineExceeded, http.StatusGatewayTimeout},
+	} {
+		stubLLM(t, failWith(tt.err))
+		for _, format := range []string{"json", "text"} {
+			w := serve(handleRoot, newTestRequest("GET", "/?q=hi&format="+format, nil))
+			if w.Code != tt.status {
+				t.Errorf("%v, format=%s: status %d, want %d", tt.err, format, w.Code, tt.status)
+			}
+			if format != "json" {
+				continue
+			}
+			var body map[string]string
+			if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil || body["error"] == "" || body["answer"] != "" {
+				t.Errorf("%v, format=json: body %q, want just an error", tt.err, w.Body.String())
+			}
+		}
+	}
+
+	// A web page that fails before any answer gets the status too; one that
+	// fails partway has already started with 200 and says so on the page
+	for _, tt := range []struct {
+		backend llmFunc
+		status  int
+	}{
+		{failWith(errors.New("upstream exploded")), http.StatusInternalServerError},
+		{failWith(errServerBusy), http.StatusServiceUnavailable},
+		{failWith(errors.New("upstream exploded"), "The answer is"), http.StatusOK},
+	} {
+		stubLLM(t, tt.backend)
+		r := newTestRequest("GET", "/?q=hi", nil)
+		r.Header.Set("User-Agent", firefoxUA)
+		w := serve(handleRoot, r)
+		if w.Code != tt.status {
+			t.Errorf("web page: status %d, want %d", w.Code, tt.status)
+		}
+		if body := w.Body.String(); !strings.Contains(body, `<p class="error">Error: `) || !strings.Contains(body, "</html>") {
+			t.Errorf("web page %q lacks the error notice or the rest of the page", body)
+		}
+	}
+}
+
+// notReady makes the backend report itself unconfigured for the rest of the test
+func notReady(t *testing.T) {
+	t.Helper()
+	old := llmReady
+	llmReady = func() error { return fmt.Errorf("%w: no API key", errNotConfigured) }
+	t.Cleanup(func() { llmReady = old })
+}
+
+func TestReadyz(t *testing.T) {
+	if w := serve(handleReadyz, httptest.NewRequest("GET", "/readyz", nil)); w.Code != http.StatusOK || w.Body.String() != "ok\n" {
+		t.Errorf("ready: status %d, body %q", w.Code, w.Body.String())
+	}
+	notReady(t)
+	if w := serve(handleReadyz, httptest.NewRequest("GET", "/readyz", nil)); w.Code != http.StatusServiceUnavailable {
+		t.Errorf("not ready: status %d, want 503", w.Code)
+	}
+}
+
+// setBuild sets the -ldflags variables for the rest of the test
+func setBuild(t *testing.T, v, c, b string) {
+	t.Helper()
+	oldV, oldC, oldB := version, commit, buildTime
+	version, commit, buildTime = v, c, b
+	t.Cleanup(func() { version, commit, buildTime = oldV, oldC, oldB })
+}
+
+func TestVersion(t *testing.T) {
+	refuseLLM(t)
+	mux := newMux()
+	get := func() BuildInfo {
+		t.Helper()
+		r := httptest.NewRequest("GET", "/version", nil)
+		r.RemoteAddr = "10.255.0.1:1234"
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, r)
+		if w.Code != http.StatusOK || w.Header().Get("Content-Type") != "application/json" {
+			t.Fatalf("status %d, Content-Type %q", w.Code, w.Header().Get("Content-Type"))
+		}
+		var info BuildInfo
+		if err := json.Unmarshal(w.Body.Bytes(), &info); err != nil {
+			t.Fatalf("body %q: %v", w.Body.String(), err)
+		}
+		return info
+	}
+
+	setBuild(t, "1.2.0", "abc123", "2026-01-02T03:04:05Z")
+	want := BuildInfo{Version: "1.2.0", Commit: "abc123", BuildTime: "2026-01-02T03:04:05Z"}
+	if got := get(); got != want {
+		t.Errorf("with -ldflags: %+v, want %+v", got, want)
+	}
+
+	// Test binaries carry no VCS details, so unset values fall back to "unknown"
+	setBuild(t, "dev", "", "")
+	want = BuildInfo{Version: "dev", Commit: "unknown", BuildTime: "unknown"}
+	if got := get(); got != want {
+		t.Errorf("without -ldflags: %+v, want %+v", got, want)
+	}
+
+	// Well past the rate limit's burst, from one client
+	for i := 0; i < 30; i++ {
+		get()
+	}
+}
+
+func TestUnconfiguredBackend(t *testing.T) {
+	refuseLLM(t)
+	useEmbeddings(t, func(ctx context.Context, model string, input []string) ([][]float64, int, error) {
+		t.Error("embeddings computed while unconfigured")
+		return nil, 0, errors.New("unexpected call")
+	})
+	notReady(t)
+
+	if w := serve(handleRoot, newTestRequest("GET", "/?q=hi", nil)); w.Code != http.StatusServiceUnavailable {
+		t.Errorf("/: status %d, want 503", w.Code)
+	}
+	for _, tt := range []struct {
+		h          http.HandlerFunc
+		path, body string
+	}{
+		{handleChatCompletions, "/v1/chat/completions", `{"messages":[{"role":"user","content":"hi"}]}`},
+		{handleEmbeddings, "/v1/embeddings", `{"input":"hi"}`},
+	} {
+		w := serve(tt.h, newTestRequest("POST", tt.path, strings.NewReader(tt.body)))
+		if w.Code != http.StatusServiceUnavailable {
+			t.Errorf("%s: status %d, want 503", tt.path, w.Code)
+			continue
+		}
+		if e := apiError(t, w); e.Code != "not_configured" {
+			t.Errorf("%s: error %+v", tt.path, e)
+		}
+	}
+}
+
+func TestBuildMessagesSystemFirst(t *testing.T) {
+	got := buildMessages([]Message{
+		{Role: "user", Content: "hi"},
+		{Role: "system", Content: "Be brief."},
+		{Role: "assistant", Content: "hello"},
+		{Role: "developer", Content: "Use French."},
+		{Role: "user", Content: "how are you?"},
+	})
+	want := []map[string]string{
+		{"role": "system", "content": "Be brief.\n\nUse French."},
+		{"role": "user", "content": "hi"},
+		{"role": "assistant", "content": "hello"},
+		{"role": "user", "content": "how are you?"},
+	}
+	if len(got) != len(want) {
+		t.Fatalf("buildMessages = %v, want %v", got, want)
+	}
+	for i := range want {
+		if !maps.Equal(got[i], want[i]) {
+			t.Errorf("message %d = %v, want %v", i, got[i], want[i])
+		}
+	}
+
+	if got := buildMessages([]Message{{Role: "user", Content: "hi"}}); len(got) != 1 || got[0]["role"] != "user" {
+		t.Errorf("without system messages: %v", got)
+	}
+}
+
+func TestChatCompletionsForwardsSystem(t *testing.T) {
+	inputs := make(chan interface{}, 1)
+	stubLLM(t, func(ctx context.Context, input interface{}, stream chan<- string) (string, error) {
+		inputs <- input
+		return replyWith("ok")(ctx, input, stream)
+	})
+	serve(handleChatCompletions, newTestRequest("POST", "/v1/chat/completions", strings.NewReader(
+		`{"messages":[{"role":"user","content":"hi"},{"role":"system","content":"Be brief."}]}`)))
+	messages, ok := (<-inputs).([]map[string]string)
+	if !ok || len(messages) != 2 || messages[0]["role"] != "system" || messages[0]["content"] != "Be brief." {
+		t.Errorf("backend got %v, want the system message first", messages)
+	}
+}
+
+func TestPathQueryNormalizes(t *testing.T) {
+	for _, tt := range []struct{ path, want string }{
+		{"/what-is-go/", "what is go"},
+		{"/what-is-go//", "what is go"},
+		{"//what-is-go", "what is go"},
+		{"/what--is---go", "what is go"},
+		{"/-what-is-go-", "what is go"},
+		{"/What-Is-Go", "What Is Go"},
+		{"/a//b", "a/b"},
+		{"/a///b/", "a/b"},
+	} {
+		if got := pathQuery(tt.path); got != tt.want {
+			t.Errorf("pathQuery(%q) = %q, want %q", tt.path, got, tt.want)
+		}
+	}
+}
+
+func TestRootPromptLengthLimit(t *testing.T) {
+	stubLLM(t, replyWith("ok"))
+	if w := serve(handleRoot, newTestRequest("GET", "/?q="+strings.Repeat("a", maxPromptLength), nil)); w.Code != http.StatusOK {
+		t.Errorf("question at the limit: status %d", w.Code)
+	}
+
+	refuseLLM(t)
+	w := serve(handleRoot, newTestRequest("GET", "/?q="+strings.Repeat("a", maxPromptLength+1), nil))
+	if w.Code != http.StatusRequestEntityTooLarge || !strings.Contains(w.Body.String(), "Question too long") {
+		t.Errorf("question over the limit: status %d, body %q", w.Code, w.Body.String())
+	}
+}
+
+func TestAPIPromptLengthLimit(t *testing.T) {
+	// Two messages, each under the limit but over it together
+	half := strings.Repeat("a", maxAPIPromptLength/2)
+	chat := func(last string) string {
+		return `{"messages":[{"role":"user","content":"` + half + `"},{"role":"assistant","content":"ok"},{"role":"user","content":"` + last + `"}]}`
+	}
+
+	stubLLM(t, replyWith("ok"))
+	if w := serve(handleChatCompletions, newTestRequest("POST", "/v1/chat/completions", strings.NewReader(chat(half[2:])))); w.Code != http.StatusOK {
+		t.Errorf("messages at the limit: status %d: %s", w.Code, w.Body.String())
+	}
+
+	refuseLLM(t)
+	w := serve(handleChatCompletions, newTestRequest("POST", "/v1/chat/completions", strings.NewReader(chat(half))))
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("messages over the limit: status %d", w.Code)
+	}
+	if e := apiError(t, w); e.Code != "context_length_exceeded" || e.Type != "invalid_request_error" {
+		t.Errorf("messages over the limit: error %+v", e)
+	}
+}
+
+// postJSON posts body to / as JSON
+func postJSON(body string) *httptest.ResponseRecorder {
+	r := newTestRequest("POST", "/", strings.NewReader(body))
+	r.Header.Set("Content-Type", "application/json")
+	return serve(handleRoot, r)
+}
+
+func TestRootJSONBody(t *testing.T) {
+	useCache(t, 0)
+	type call struct {
+		input interface{}
+		model string
+	}
+	calls := make(chan call, 1)
+	stubLLM(t, func(ctx context.Context, input interface{}, stream chan<- string) (string, error) {
+		calls <- call{input, requestedModel(ctx)}
+		return replyWith("four")(ctx, input, stream)
+	})
+
+	for _, h := range []string{`[{"q":"hello","a":"hi there"}]`, `"Q: hello\nA: hi there\n\n"`} {
+		w := postJSON(`{"q":"what is 2+2","h":` + h + `,"system":"Be terse."}`)
+		if w.Code != http.StatusOK || !strings.HasPrefix(w.Header().Get("Content-Type"), "application/json") {
+			t.Fatalf("h=%s: status %d, Content-Type %q", h, w.Code, w.Header().Get("Content-Type"))
+		}
+		var resp map[string]string
+		if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil || resp["question"] != "what is 2+2" || resp["answer"] != "four" {
+			t.Errorf("h=%s: response %s (%v)", h, w.Body.String(), err)
+		}
+		c := <-calls
+		messages, ok := c.input.([]map[string]string)
+		if !ok || len(messages) != 2 || messages[0]["role"] != "system" || messages[0]["content"] != "Be terse." {
+			t.Fatalf("h=%s: input %v, want the system message first", h, c.input)
+		}
+		if prompt := messages[1]["content"]; !strings.Contains(prompt, "Q: hello\nA: hi there") || !strings.HasSuffix(prompt, "Q: what is 2+2") {
+			t.Errorf("h=%s: prompt %q, want the history before the question", h, prompt)
+		}
+		if c.model != "" {
+			t.Errorf("h=%s: model %q asked for, want the default", h, c.model)
+		}
+	}
+
+	old := allowedModels
+	allowedModels = []string{"small-model"}
+	t.Cleanup(func() { allowedModels = old })
+	if w := postJSON(`{"q":"hi","model":"small-model"}`); w.Code != http.StatusOK {
+		t.Errorf("allowed model: status %d", w.Code)
+	} else if c := <-calls; c.model != "small-model" {
+		t.Errorf("allowed model: backend asked for %q", c.model)
+	}
+
+	refuseLLM(t)
+	for _, body := range []string{`{"q":"hi","model":"expensive-model"}`, `{"q":`} {
+		if w := postJSON(body); w.Code != http.StatusBadRequest {
+			t.Errorf("%s: status %d, want 400", body, w.Code)
+		}
+	}
+}
+
+func TestModelAllowed(t *testing.T) {
+	old := allowedModels
+	allowedModels = []string{"listed"}
+	t.Cleanup(func() { allowedModels = old })
+	for model, want := range map[string]bool{"listed": true, "unlisted": false, "": false} {
+		if got := modelAllowed(model); got != want {
+			t.Errorf("modelAllowed(%q) = %v", model, got)
+		}
+	}
+}
+
+func TestCORSPreflight(t *testing.T) {
+	refuseLLM(t)
+	for _, tt := range []struct {
+		h       http.HandlerFunc
+		path    string
+		methods string
+	}{
+		{handleRoot, "/", "GET, POST, OPTIONS"},
+		{handleChatCompletions, "/v1/chat/completions", "POST, OPTIONS"},
+		{handleEmbeddings, "/v1/embeddings", "POST, OPTIONS"},
+	} {
+		// More than the rate limit allows, from one address: preflights don't count
+		addr := testAddr()
+		for i := 0; i < 20; i++ {
+			r := httptest.NewRequest("OPTIONS", tt.path, nil)
+			r.RemoteAddr = addr
+			r.Header.Set("Origin", "https://example.com")
+			r.Header.Set("Access-Control-Request-Method", "POST")
+			r.Header.Set("Access-Control-Request-Headers", "content-type, accept")
+			w := serve(tt.h, r)
+			if w.Code != http.StatusOK || w.Body.Len() != 0 {
+				t.Fatalf("%s preflight %d: status %d, body %q", tt.path, i, w.Code, w.Body.String())
+			}
+			h := w.Header()
+			if h.Get("Access-Control-Allow-Origin") != "*" || h.Get("Access-Control-Allow-Methods") != tt.methods ||
+				!strings.Contains(h.Get("Access-Control-Allow-Headers"), "Content-Type, Accept") {
+				t.Fatalf("%s preflight: headers %v", tt.path, h)
+			}
+		}
+	}
+
+	stubLLM(t, replyWith("ok"))
+	if w := serve(handleRoot, newTestRequest("GET", "/?q=hi", nil)); w.Header().Get("Access-Control-Allow-Origin") != "*" {
+		t.Error("answer without Access-Control-Allow-Origin")
+	}
+}
+
+func TestLimitDuration(t *testing.T) {
+	slow := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-time.After(time.Second):
+			w.Write([]byte("finished"))
+		case <-r.Context().Done():
+		}
+	})
+	h := limitDuration(slow, 50*time.Millisecond)
+
+	start := time.Now()
+	w := serve(h.ServeHTTP, newTestRequest("GET", "/?q=hi&format=text", nil))
+	if w.Code != http.StatusServiceUnavailable || !strings.Contains(w.Body.String(), "Request timed out") {
+		t.Errorf("slow answer: status %d, body %q; want a 503", w.Code, w.Body.String())
+	}
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Errorf("cut off after %s", elapsed)
+	}
+
+	// Streams manage their own lifetime
+	if w := serve(h.ServeHTTP, newTestRequest("GET", "/?q=hi&format=stream", nil)); w.Body.String() != "finished" {
+		t.Errorf("stream: status %d, body %q; want it left to finish", w.Code, w.Body.String())
+	}
+
+	if got := limitDuration(slow, 0); reflect.ValueOf(got).Pointer() != reflect.ValueOf(slow).Pointer() {
+		t.Error("limitDuration with no timeout wrapped the handler")
+	}
+}
+
+func TestMayStream(t *testing.T) {
+	for _, tt := range []struct {
+		method, target, contentType, accept string
+		want                                bool
+	}{
+		{"GET", "/?q=hi", "", "", false},
+		{"GET", "/?q=hi", "", "text/event-stream", true},
+		{"GET", "/?q=hi&format=ndjson", "", "", true},
+		{"GET", "/?q=hi&format=json", "", "", false},
+		{"POST", "/", "application/json", "text/event-stream", false},
+		{"POST", "/v1/chat/completions", "application/json", "", true},
+		{"POST", "/v1/embeddings", "application/json", "", false},
+		{"GET", "/readyz", "", "text/event-stream", false},
+	} {
+		r := httptest.NewRequest(tt.method, tt.target, nil)
+		r.Header.Set("Content-Type", tt.contentType)
+		r.Header.Set("Accept", tt.accept)
+		if got := mayStream(r); got != tt.want {
+			t.Errorf("%s %s (%q, Accept %q): mayStream = %v", tt.method, tt.target, tt.contentType, tt.accept, got)
+		}
+	}
+}
+
+func TestAPIUnknownRoute(t *testing.T) {
+	refuseLLM(t)
+	mux := newMux()
+	for _, tt := range []struct{ method, path string }{
+		{"GET", "/v1/models"},
+		{"POST", "/v1/completions"},
+		{"POST", "/v1/chat/completion"},
+		{"DELETE", "/v1/"},
+	} {
+		w := serve(mux.ServeHTTP, newTestRequest(tt.method, tt.path, strings.NewReader("{}")))
+		if w.Code != http.StatusNotFound {
+			t.Errorf("%s %s: status %d, want 404", tt.method, tt.path, w.Code)
+			continue
+		}
+		e := apiError(t, w)
+		if e.Code != "unknown_url" || e.Type != "invalid_request_error" || !strings.Contains(e.Message, tt.method+" "+tt.path) {
+			t.Errorf("%s %s: error %+v", tt.method, tt.path, e)
+		}
+	}
+
+	// Known routes are still theirs
+	if w := serve(mux.ServeHTTP, newTestRequest("GET", "/v1/chat/completions", nil)); w.Code != http.StatusMethodNotAllowed {
+		t.Errorf("GET /v1/chat/completions: status %d, want 405", w.Code)
+	}
+}
+
+func TestAPIMultiTurnStream(t *testing.T) {
+	useCache(t, 0)
+	inputs := make(chan []map[string]string, 1)
+	// A backend that remembers a name from an earlier turn
+	stubLLM(t, func(ctx context.Context, input interface{}, stream chan<- string) (string, error) {
+		messages, _ := input.([]map[string]string)
+		inputs <- messages
+		name := "nobody"
+		for _, m := range messages {
+			if n, ok := strings.CutPrefix(m["content"], "My name is "); ok && m["role"] == "user" {
+				name = n
+			}
+		}
+		return replyWith("You are ", name)(ctx, input, stream)
+	})
+
+	const body = `{"stream":%v,"messages":[
+		{"role":"system","content":"Be brief."},
+		{"role":"user","content":"My name is Ada"},
+		{"role":"assistant","content":"Hello, Ada."},
+		{"role":"user","content":"Who am I?"}]}`
+	want := []map[string]string{
+		{"role": "system", "content": "Be brief."},
+		{"role": "user", "content": "My name is Ada"},
+		{"role": "assistant", "content": "Hello, Ada."},
+		{"role": "user", "content": "Who am I?"},
+	}
+	for _, stream := range []bool{false, true} {
+		w := serve(handleChatCompletions, newTestRequest("POST", "/v1/chat/completions", strings.NewReader(fmt.Sprintf(body, stream))))
+		if w.Code != http.StatusOK {
+			t.Fatalf("stream %v: status %d: %s", stream, w.Code, w.Body.String())
+		}
+		if got := <-inputs; !reflect.DeepEqual(got, want) {
+			t.Errorf("stream %v: backend got %v, want every turn with its role", stream, got)
+		}
+		if !strings.Contains(w.Body.String(), "Ada") {
+			t.Errorf("stream %v: answer %s doesn't use the earlier turn", stream, w.Body.String())
+		}
+	}
+}
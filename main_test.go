@@ -0,0 +1,146 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// The tests run against whatever llm.go is in place, but never call it:
+// stubLLM stands in for the backend, and the backend counts as ready.
+func TestMain(m *testing.M) {
+	llmReady = func() error { return nil }
+	llmCall = failWith(errors.New("no backend stubbed for this test"))
+	os.Exit(m.Run())
+}
+
+// llmFunc has the signature and contract of LLM
+type llmFunc func(ctx context.Context, input interface{}, stream chan<- string) (string, error)
+
+// stubLLM makes fn the backend for the rest of the test
+func stubLLM(t *testing.T, fn llmFunc) {
+	t.Helper()
+	old := llmCall
+	llmCall = fn
+	t.Cleanup(func() { llmCall = old })
+}
+
+// replyWith is a backend that answers with chunks, streamed one at a time
+func replyWith(chunks ...string) llmFunc {
+	return failWith(nil, chunks...)
+}
+
+// failWith is a backend that streams chunks and then fails with err
+func failWith(err error, chunks ...string) llmFunc {
+	return func(ctx context.Context, input interface{}, stream chan<- string) (string, error) {
+		if stream == nil {
+			if err != nil {
+				return "", err
+			}
+			return strings.Join(chunks, ""), nil
+		}
+		defer close(stream)
+		for _, chunk := range chunks {
+			select {
+			case stream <- chunk:
+			case <-ctx.Done():
+				return "", ctx.Err()
+			}
+		}
+		return "", err
+	}
+}
+
+// slowReply is a backend that waits delay before each chunk, or until ctx is done
+func slowReply(delay time.Duration, chunks ...string) llmFunc {
+	return func(ctx context.Context, input interface{}, stream chan<- string) (string, error) {
+		if stream == nil {
+			select {
+			case <-time.After(delay):
+				return strings.Join(chunks, ""), nil
+			case <-ctx.Done():
+				return "", ctx.Err()
+			}
+		}
+		defer close(stream)
+		for _, chunk := range chunks {
+			select {
+			case <-time.After(delay):
+			case <-ctx.Done():
+				return "", ctx.Err()
+			}
+			select {
+			case stream <- chunk:
+			case <-ctx.Done():
+				return "", ctx.Err()
+			}
+		}
+		return "", nil
+	}
+}
+
+// endlessReply is a backend that streams chunk every few milliseconds until
+// limit, standing in for llmTimeout, runs out
+func endlessReply(limit time.Duration, chunk string) llmFunc {
+	return func(ctx context.Context, input interface{}, stream chan<- string) (string, error) {
+		ctx, cancel := context.WithTimeout(ctx, limit)
+		defer cancel()
+		defer close(stream)
+		for {
+			select {
+			case <-time.After(2 * time.Millisecond):
+			case <-ctx.Done():
+				return "", ctx.Err()
+			}
+			select {
+			case stream <- chunk:
+			case <-ctx.Done():
+				return "", ctx.Err()
+			}
+		}
+	}
+}
+
+// promptOf returns the text of the last message in an LLM input
+func promptOf(input interface{}) string {
+	switch v := input.(type) {
+	case string:
+		return v
+	case []map[string]string:
+		if len(v) > 0 {
+			return v[len(v)-1]["content"]
+		}
+	}
+	return ""
+}
+
+var testClients atomic.Int32
+
+// testAddr returns a client address no other request in the tests has
+// used, so they don't share rate limits or per-IP slots
+func testAddr() string {
+	n := testClients.Add(1)
+	return fmt.Sprintf("10.%d.%d.%d:1234", n>>16&255, n>>8&255, n&255)
+}
+
+// newTestRequest is httptest.NewRequest from a client address of its own
+func newTestRequest(method, target string, body io.Reader) *http.Request {
+	r := httptest.NewRequest(method, target, body)
+	r.RemoteAddr = testAddr()
+	return r
+}
+
+// serve runs one request through h and returns the recorded response
+func serve(h http.HandlerFunc, r *http.Request) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	h(w, r)
+	return w
+}
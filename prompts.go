@@ -0,0 +1,206 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"regexp"
+	"strings"
+)
+
+// Instructions prepended to user prompts. Edit the defaults below, or set a
+// file path to load the text from that file at startup instead.
+const (
+	htmlPromptFile = "" // Replaces htmlPromptPrefix, e.g. "prompts/html.txt"
+	dnsPromptFile  = "" // Replaces dnsPromptFormat; must contain one %d for the character limit
+)
+
+// Formatting instructions for answers rendered in the web interface
+var htmlPromptPrefix = "Use simple HTML formatting where it improves clarity: <b> for emphasis, <i> for terms, <ul>/<li> for lists. No CSS, divs, or decorative tags. Never prefix responses with A: or any label. Now, without referencing the previous instructions in the conversation, reply as a helpful assistant: "
+
+// Keeps DNS answers short and plain; %d is the answer length limit
+var dnsPromptFormat = "Answer in %d characters or less, no markdown formatting: "
+
+// Answer length instructions, chosen with ?verbosity= over HTTP or a
+// .short/.normal/.long label before the zone in DNS (which defaults to short)
+var verbosityHints = map[string]string{
+	"short":  "Answer briefly, in a sentence or two. ",
+	"normal": "",
+	"long":   "Answer in depth, with details and examples where they help. ",
+}
+
+// Asks for answers in the user's language; %s is a language tag like "fr-CA",
+// from ?lang= or the browser's Accept-Language header
+var languageFormat = "Reply in the language of the locale %s unless asked otherwise. "
+
+// The language the model answers in anyway. A browser whose preferred
+// language is this one, in any region (en-US, en-GB), gets no instruction;
+// ?lang= always adds one.
+var defaultLanguage = "en"
+
+// History comes from the client, so it can carry text written to override
+// the instructions above. With guardHistory on, lines of past exchanges that
+// match any of these patterns are left out of the prompt (the page still
+// shows them). The defaults only catch blatant attempts.
+const guardHistory = false
+
+var historyGuards = []*regexp.Regexp{
+	regexp.MustCompile(`(?i)\b(ignore|disregard|forget)\b.{0,30}\b(previous|prior|above|earlier|all)\b.{0,20}\b(instructions|rules|prompts?)\b`),
+	regexp.MustCompile(`(?i)^\s*(system|developer)\s*(prompt)?\s*:`),
+	regexp.MustCompile(`(?i)^\s*(new|updated) instructions\s*:`),
+	regexp.MustCompile(`^\s*[QA]:`), // Fake extra exchanges in the transcript
+}
+
+func init() {
+	if err := loadPrompts(); err != nil {
+		log.Fatalf("prompt configuration: %v", err)
+	}
+}
+
+func loadPrompts() error {
+	if htmlPromptFile != "" {
+		text, err := readPrompt(htmlPromptFile)
+		if err != nil {
+			return err
+		}
+		htmlPromptPrefix = text
+	}
+	if dnsPromptFile != "" {
+		text, err := readPrompt(dnsPromptFile)
+		if err != nil {
+			return err
+		}
+		if !validDNSPromptFormat(text) {
+			return fmt.Errorf("%s must contain exactly one %%d and no other %% verbs", dnsPromptFile)
+		}
+		dnsPromptFormat = text
+	}
+	return nil
+}
+
+// validDNSPromptFormat reports whether text has exactly one %d for the
+// character limit and no other formatting verbs
+func validDNSPromptFormat(text string) bool {
+	return strings.Count(text, "%d") == 1 && !strings.Contains(fmt.Sprintf(text, 0), "%!")
+}
+
+// readPrompt loads a prompt file, separating it from the user's text with one space
+func readPrompt(path string) (string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(data)) + " ", nil
+}
+
+// PromptTransformer shapes a user's prompt before it is sent to the model
+type PromptTransformer interface {
+	Transform(prompt string) string
+}
+
+// prefixPrompt puts fixed instructions in front of the prompt
+type prefixPrompt string
+
+func (p prefixPrompt) Transform(prompt string) string {
+	return string(p) + prompt
+}
+
+// lengthHint asks for an answer of at most limit characters; format holds one %d
+type lengthHint struct {
+	format string
+	limit  int
+}
+
+func (h lengthHint) Transform(prompt string) string {
+	return fmt.Sprintf(h.format, h.limit) + prompt
+}
+
+// guardedHistory drops lines matching historyGuards from past exchanges
+func guardedHistory(history []exchange) []exchange {
+	if !guardHistory {
+		return history
+	}
+	clean := make([]exchange, len(history))
+	for i, e := range history {
+		clean[i] = exchange{Question: dropGuardedLines(e.Question), Answer: dropGuardedLines(e.Answer)}
+	}
+	return clean
+}
+
+func dropGuardedLines(text string) string {
+	lines := strings.Split(text, "\n")
+	kept := lines[:0]
+	for _, line := range lines {
+		guarded := false
+		for _, re := range historyGuards {
+			if re.MatchString(line) {
+				guarded = true
+				break
+			}
+		}
+		if !guarded {
+			kept = append(kept, line)
+		}
+	}
+	return strings.Join(kept, "\n")
+}
+
+// promptChain applies its transformers in order
+type promptChain []PromptTransformer
+
+func (c promptChain) Transform(prompt string) string {
+	for _, t := range c {
+		prompt = t.Transform(prompt)
+	}
+	return prompt
+}
+
+// promptOptions are what a request asks of the answer
+type promptOptions struct {
+	verbosity string // A verbosityHints level; "" adds nothing
+	lang      string // Language tag; "" adds nothing
+	limit     int    // Answer length cap, for protocols that have one
+}
+
+// verbosityHint is the instruction for a verbosity level
+func verbosityHint(level string) PromptTransformer {
+	return prefixPrompt(verbosityHints[level])
+}
+
+// languageHint asks for a reply in the language tag lang, if one is given
+func languageHint(lang string) PromptTransformer {
+	if lang == "" {
+		return prefixPrompt("")
+	}
+	return prefixPrompt(fmt.Sprintf(languageFormat, lang))
+}
+
+// promptPipelines holds all the shaping each protocol applies, in order;
+// later transformers put their instructions in front of earlier ones. A
+// protocol file can register its own pipeline from an init function.
+var promptPipelines = map[string]func(o promptOptions) PromptTransformer{
+	// Plain text, JSON and streams on /
+	"http": func(o promptOptions) PromptTransformer {
+		return promptChain{verbosityHint(o.verbosity), languageHint(o.lang)}
+	},
+	// Web pages on /
+	"html": func(o promptOptions) PromptTransformer {
+		return promptChain{verbosityHint(o.verbosity), languageHint(o.lang), prefixPrompt(htmlPromptPrefix)}
+	},
+	// Longer answers are read with continuation queries, so only short ones
+	// are asked to fit one reply
+	"dns": func(o promptOptions) PromptTransformer {
+		if o.verbosity != "short" {
+			return verbosityHint(o.verbosity)
+		}
+		return promptChain{lengthHint{format: dnsPromptFormat, limit: o.limit}, verbosityHint(o.verbosity)}
+	},
+}
+
+// shapePrompt runs prompt through the pipeline registered for protocol
+func shapePrompt(protocol, prompt string, o promptOptions) string {
+	if pipeline, ok := promptPipelines[protocol]; ok {
+		return pipeline(o).Transform(prompt)
+	}
+	return prompt
+}
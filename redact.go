@@ -0,0 +1,140 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"regexp"
+	"strings"
+	"unicode/utf8"
+)
+
+// Output redaction. Text in model answers matching any of these regular
+// expressions is replaced before it reaches a client, on every protocol.
+// Streams hold back their last redactHold bytes, and any match that may
+// still grow, so matches split across chunks are caught as long as they
+// are no longer than redactHold.
+const (
+	redactFile        = ""           // Extra patterns, one per line, e.g. "redact.txt"
+	redactReplacement = "[redacted]" // What each match becomes
+	redactHold        = 64           // Bytes a stream is held back by while rules are set
+)
+
+var redactPatterns = []string{
+	// `sk-[A-Za-z0-9_-]{20,}`, // API keys
+}
+
+var redactRules []*regexp.Regexp
+
+func init() {
+	if err := loadRedactRules(); err != nil {
+		log.Fatalf("redaction rules: %v", err)
+	}
+}
+
+func loadRedactRules() error {
+	patterns := redactPatterns
+	if redactFile != "" {
+		data, err := os.ReadFile(redactFile)
+		if err != nil {
+			return err
+		}
+		for _, line := range strings.Split(string(data), "\n") {
+			if line = strings.TrimSpace(line); line != "" && !strings.HasPrefix(line, "#") {
+				patterns = append(patterns, line)
+			}
+		}
+	}
+	for _, pattern := range patterns {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return fmt.Errorf("%q: %v", pattern, err)
+		}
+		redactRules = append(redactRules, re)
+	}
+	return nil
+}
+
+func redact(text string) string {
+	for _, re := range redactRules {
+		text = re.ReplaceAllLiteralString(text, redactReplacement)
+	}
+	return text
+}
+
+// redactFilter redacts a stream, holding back its last redactHold bytes
+// until more text shows whether they belong to a match
+type redactFilter struct {
+	pending string
+}
+
+func (f *redactFilter) Write(chunk string) string {
+	f.pending += chunk
+	cut := len(f.pending) - redactHold
+	// A match running past the cut could still grow, so hold all of it
+	for moved := true; moved && cut > 0; {
+		moved = false
+		for _, re := range redactRules {
+			for _, loc := range re.FindAllStringIndex(f.pending, -1) {
+				if loc[0] < cut && loc[1] > cut {
+					cut, moved = loc[0], true
+				}
+			}
+		}
+	}
+	for cut > 0 && !utf8.RuneStart(f.pending[cut]) {
+		cut--
+	}
+	if cut <= 0 {
+		return ""
+	}
+	out := f.pending[:cut]
+	f.pending = f.pending[cut:]
+	return redact(out)
+}
+
+func (f *redactFilter) Flush() string {
+	out := f.pending
+	f.pending = ""
+	return redact(out)
+}
+
+// askLLM is how every protocol asks the model. It has LLM's contract and adds
+// the server's own policies: the response cache, the cap on concurrent
+// upstream calls, and output redaction. llm.go only talks to the backend.
+func askLLM(ctx context.Context, input interface{}, stream chan<- string) (string, error) {
+	if len(redactRules) == 0 {
+		return cachedLLM(ctx, input, stream)
+	}
+	if stream == nil {
+		answer, err := cachedLLM(ctx, input, nil)
+		return redact(answer), err
+	}
+	defer close(stream)
+
+	inner := make(chan string)
+	errc := make(chan error, 1)
+	go func() {
+		_, err := cachedLLM(ctx, input, inner)
+		errc <- err
+	}()
+
+	send := func(text string) {
+		if text == "" || ctx.Err() != nil {
+			return
+		}
+		select {
+		case stream <- text:
+		case <-ctx.Done():
+		}
+	}
+	// Keep draining after ctx is done so LLM can close inner and return
+	var f redactFilter
+	for chunk := range inner {
+		send(f.Write(chunk))
+	}
+	err := <-errc
+	send(f.Flush())
+	return "", err
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"context"
+	"regexp"
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+// useRedactRules makes patterns the redaction rules for the rest of the test
+func useRedactRules(t *testing.T, patterns ...string) {
+	t.Helper()
+	old := redactRules
+	redactRules = nil
+	for _, p := range patterns {
+		redactRules = append(redactRules, regexp.MustCompile(p))
+	}
+	t.Cleanup(func() { redactRules = old })
+}
+
+func TestRedact(t *testing.T) {
+	useRedactRules(t, `sk-[A-Za-z0-9]{8,}`, `\d{3}-\d{2}-\d{4}`)
+	got := redact("key sk-abcdefgh123 and 123-45-6789, not sk-short")
+	if want := "key [redacted] and [redacted], not sk-short"; got != want {
+		t.Errorf("redact = %q, want %q", got, want)
+	}
+}
+
+func TestRedactFilterSplitMatches(t *testing.T) {
+	useRedactRules(t, `sk-[A-Za-z0-9]{8,}`)
+	text := strings.Repeat("padding ", 20) + "key sk-abcdefgh123 done " + strings.Repeat("more ", 20)
+	// Every split point, including ones inside the key
+	for _, size := range []int{1, 3, 7, 16, 100} {
+		var f redactFilter
+		var out strings.Builder
+		for i := 0; i < len(text); i += size {
+			out.WriteString(f.Write(text[i:min(i+size, len(text))]))
+		}
+		out.WriteString(f.Flush())
+		if got, want := out.String(), strings.Replace(text, "sk-abcdefgh123", redactReplacement, 1); got != want {
+			t.Errorf("chunks of %d: %q, want %q", size, got, want)
+		}
+	}
+}
+
+func TestRedactFilterKeepsRunes(t *testing.T) {
+	useRedactRules(t, `secret`)
+	text := strings.Repeat("é", redactHold)
+	var f redactFilter
+	var out strings.Builder
+	for i := 0; i < len(text); i++ {
+		part := f.Write(text[i : i+1])
+		if !utf8.ValidString(part) {
+			t.Fatalf("byte %d: released %q, splitting a rune", i, part)
+		}
+		out.WriteString(part)
+	}
+	if out.WriteString(f.Flush()); out.String() != text {
+		t.Errorf("text %q came out as %q", text, out.String())
+	}
+}
+
+func TestAskLLMRedacts(t *testing.T) {
+	useCache(t, 0)
+	useRedactRules(t, `sk-[A-Za-z0-9]{8,}`)
+	stubLLM(t, replyWith("your key is sk-abcd", "efgh123, keep it safe"))
+	want := "your key is [redacted], keep it safe"
+
+	if answer, err := askLLM(context.Background(), "key?", nil); err != nil || answer != want {
+		t.Errorf("whole answer %q (err %v), want %q", answer, err, want)
+	}
+
+	ch := make(chan string)
+	go askLLM(context.Background(), "key?", ch)
+	var streamed strings.Builder
+	for chunk := range ch {
+		streamed.WriteString(chunk)
+	}
+	if streamed.String() != want {
+		t.Errorf("stream %q, want %q", streamed.String(), want)
+	}
+}
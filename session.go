@@ -0,0 +1,71 @@
+package main
+
+import (
+	"net/http"
+	"slices"
+	"sync"
+	"time"
+)
+
+// Optional server-side history for the web interface. When enabled, a browser
+// sends a session cookie instead of posting its whole conversation back in the
+// hidden form field. Sessions hold only the conversation, live in memory and
+// expire after sessionTTL; browsers without the cookie keep using the field.
+const (
+	webSessions   = false            // Off by default: the server then stores nothing
+	sessionTTL    = 30 * time.Minute // Idle time before a conversation is forgotten
+	maxSessions   = 10000            // Beyond this, the longest-idle conversation is forgotten
+	sessionCookie = "chat"
+)
+
+var (
+	sessionsMu sync.Mutex // Makes reading and then updating a session atomic
+	sessions   Store      = newMemoryStore(maxSessions)
+)
+
+// openSession returns the live session named by the request's cookie and its
+// history, or starts a new one and sets the cookie. It must be called before
+// the response is written.
+func openSession(w http.ResponseWriter, r *http.Request) (id string, history []exchange, ok bool) {
+	sessionsMu.Lock()
+	defer sessionsMu.Unlock()
+
+	if c, err := r.Cookie(sessionCookie); err == nil {
+		if value, found := sessions.Get(c.Value); found {
+			history = value.([]exchange)
+			sessions.Set(c.Value, history, sessionTTL)
+			// The cookie expires like the session, so renew it too
+			setSessionCookie(w, r, c.Value)
+			return c.Value, slices.Clone(history), true
+		}
+	}
+
+	id = newRequestID()
+	sessions.Set(id, []exchange(nil), sessionTTL)
+	setSessionCookie(w, r, id)
+	return id, nil, false
+}
+
+func setSessionCookie(w http.ResponseWriter, r *http.Request, id string) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionCookie,
+		Value:    id,
+		Path:     "/",
+		MaxAge:   int(sessionTTL.Seconds()),
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+		SameSite: http.SameSiteStrictMode,
+	})
+}
+
+// saveSession replaces the history stored for id
+func saveSession(id string, history []exchange) {
+	if id == "" {
+		return
+	}
+	sessionsMu.Lock()
+	defer sessionsMu.Unlock()
+	if _, ok := sessions.Get(id); ok {
+		sessions.Set(id, history, sessionTTL)
+	}
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"crypto/tls"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// useSessions gives the rest of the test an empty session store
+func useSessions(t *testing.T) {
+	t.Helper()
+	old := sessions
+	sessions = newMemoryStore(maxSessions)
+	t.Cleanup(func() { sessions = old })
+}
+
+// sessionCookieOf returns the session cookie set on w, or nil
+func sessionCookieOf(w *httptest.ResponseRecorder) *http.Cookie {
+	for _, c := range w.Result().Cookies() {
+		if c.Name == sessionCookie {
+			return c
+		}
+	}
+	return nil
+}
+
+func TestOpenSessionStartsNew(t *testing.T) {
+	useSessions(t)
+	w := httptest.NewRecorder()
+	id, history, ok := openSession(w, httptest.NewRequest("GET", "/", nil))
+	if ok || history != nil || id == "" {
+		t.Errorf("openSession = %q, %v, %v; want a new empty session", id, history, ok)
+	}
+	c := sessionCookieOf(w)
+	if c == nil || c.Value != id || !c.HttpOnly || c.SameSite != http.SameSiteStrictMode || c.MaxAge != int(sessionTTL.Seconds()) {
+		t.Errorf("cookie %+v, want an HttpOnly strict cookie for %s", c, id)
+	}
+	if c.Secure {
+		t.Error("cookie marked Secure over plain HTTP")
+	}
+
+	r := httptest.NewRequest("GET", "/", nil)
+	r.TLS = &tls.ConnectionState{}
+	w = httptest.NewRecorder()
+	openSession(w, r)
+	if c := sessionCookieOf(w); c == nil || !c.Secure {
+		t.Errorf("cookie %+v over HTTPS, want Secure", c)
+	}
+}
+
+func TestSessionKeepsHistory(t *testing.T) {
+	useSessions(t)
+	id, _, _ := openSession(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+	saved := []exchange{{Question: "hi", Answer: "hello"}}
+	saveSession(id, saved)
+
+	r := httptest.NewRequest("POST", "/", nil)
+	r.AddCookie(&http.Cookie{Name: sessionCookie, Value: id})
+	w := httptest.NewRecorder()
+	gotID, history, ok := openSession(w, r)
+	if !ok || gotID != id || len(history) != 1 || history[0] != saved[0] {
+		t.Errorf("openSession = %q, %v, %v; want session %s with its history", gotID, history, ok, id)
+	}
+	if c := sessionCookieOf(w); c == nil || c.Value != id {
+		t.Errorf("cookie %+v, want session %s renewed", c, id)
+	}
+
+	// The caller's copy is its own
+	history[0].Answer = "changed"
+	_, again, _ := openSession(httptest.NewRecorder(), r)
+	if again[0].Answer != "hello" {
+		t.Error("changing the returned history changed the stored one")
+	}
+}
+
+func TestSessionUnknownOrGone(t *testing.T) {
+	useSessions(t)
+	saveSession("never-opened", []exchange{{Question: "q", Answer: "a"}})
+	if _, ok := sessions.Get("never-opened"); ok {
+		t.Error("saveSession created a session")
+	}
+	saveSession("", nil)
+
+	id, _, _ := openSession(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+	sessions.Delete(id) // As if it expired
+	r := httptest.NewRequest("POST", "/", nil)
+	r.AddCookie(&http.Cookie{Name: sessionCookie, Value: id})
+	newID, history, ok := openSession(httptest.NewRecorder(), r)
+	if ok || history != nil || newID == id {
+		t.Errorf("openSession with an expired cookie = %q, %v, %v; want a fresh session", newID, history, ok)
+	}
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// Store holds short-lived server state, such as cached answers and web
+// sessions, under string keys. Nothing is ever written to disk.
+type Store interface {
+	// Get returns the value stored under key, if it hasn't expired
+	Get(key string) (any, bool)
+	// Set stores value under key for ttl, replacing any earlier value
+	Set(key string, value any, ttl time.Duration)
+	Delete(key string)
+}
+
+type storeEntry struct {
+	value   any
+	expires time.Time
+}
+
+// memoryStore is a Store of at most size entries. When full, Set drops
+// expired entries and then, if still full, the entry closest to expiring.
+type memoryStore struct {
+	mu      sync.Mutex
+	size    int
+	entries map[string]storeEntry
+}
+
+func newMemoryStore(size int) *memoryStore {
+	return &memoryStore{size: size, entries: make(map[string]storeEntry)}
+}
+
+func (s *memoryStore) Get(key string) (any, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	entry, ok := s.entries[key]
+	if !ok {
+		return nil, false
+	}
+	if time.Now().After(entry.expires) {
+		delete(s.entries, key)
+		return nil, false
+	}
+	return entry.value, true
+}
+
+func (s *memoryStore) Set(key string, value any, ttl time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	if _, ok := s.entries[key]; !ok && len(s.entries) >= s.size {
+		for k, entry := range s.entries {
+			if now.After(entry.expires) {
+				delete(s.entries, k)
+			}
+		}
+		if len(s.entries) >= s.size {
+			var oldest string
+			for k, entry := range s.entries {
+				if oldest == "" || entry.expires.Before(s.entries[oldest].expires) {
+					oldest = k
+				}
+			}
+			delete(s.entries, oldest)
+		}
+	}
+	s.entries[key] = storeEntry{value: value, expires: now.Add(ttl)}
+}
+
+func (s *memoryStore) Delete(key string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.entries, key)
+}
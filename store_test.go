@@ -0,0 +1,98 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestMemoryStoreExpiry(t *testing.T) {
+	s := newMemoryStore(10)
+	s.Set("short", 1, 20*time.Millisecond)
+	s.Set("long", 2, time.Minute)
+	if v, ok := s.Get("short"); !ok || v != 1 {
+		t.Fatalf("short before expiry: %v, %v", v, ok)
+	}
+	time.Sleep(30 * time.Millisecond)
+	if v, ok := s.Get("short"); ok {
+		t.Errorf("short after expiry: %v", v)
+	}
+	if v, ok := s.Get("long"); !ok || v != 2 {
+		t.Errorf("long: %v, %v", v, ok)
+	}
+
+	// Setting again replaces the value and its lifetime
+	s.Set("long", 3, 20*time.Millisecond)
+	time.Sleep(30 * time.Millisecond)
+	if v, ok := s.Get("long"); ok {
+		t.Errorf("long after its new ttl: %v", v)
+	}
+}
+
+func TestMemoryStoreDelete(t *testing.T) {
+	s := newMemoryStore(10)
+	s.Set("k", "v", time.Minute)
+	s.Delete("k")
+	s.Delete("missing")
+	if v, ok := s.Get("k"); ok {
+		t.Errorf("deleted key still holds %v", v)
+	}
+}
+
+func TestMemoryStoreEviction(t *testing.T) {
+	s := newMemoryStore(3)
+	s.Set("a", 1, 3*time.Minute)
+	s.Set("b", 2, time.Minute) // Closest to expiring
+	s.Set("c", 3, 2*time.Minute)
+	s.Set("d", 4, 4*time.Minute)
+	if _, ok := s.Get("b"); ok {
+		t.Error("b, the entry closest to expiring, was kept")
+	}
+	for _, k := range []string{"a", "c", "d"} {
+		if _, ok := s.Get(k); !ok {
+			t.Errorf("%s evicted instead of b", k)
+		}
+	}
+
+	// Replacing a key when full evicts nothing
+	s.Set("a", 5, 3*time.Minute)
+	if n := len(s.entries); n != 3 {
+		t.Errorf("%d entries after replacing one, want 3", n)
+	}
+
+	// Expired entries go before live ones
+	s.Set("c", 3, time.Millisecond)
+	s.Set("d", 4, time.Millisecond)
+	time.Sleep(5 * time.Millisecond)
+	s.Set("e", 6, time.Minute)
+	if _, ok := s.Get("a"); !ok {
+		t.Error("a live entry was evicted while expired ones were left")
+	}
+	if n := len(s.entries); n != 2 {
+		t.Errorf("%d entries, want a and e", n)
+	}
+}
+
+func TestMemoryStoreConcurrent(t *testing.T) {
+	s := newMemoryStore(50)
+	var wg sync.WaitGroup
+	for i := range 20 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := range 200 {
+				key := fmt.Sprintf("k%d", (i*200+j)%80)
+				s.Set(key, j, time.Minute)
+				s.Get(key)
+				if j%10 == 0 {
+					s.Delete(key)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	if n := len(s.entries); n > 50 {
+		t.Errorf("%d entries, more than the size of 50", n)
+	}
+}
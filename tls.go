@@ -0,0 +1,110 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"log"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// TLS certificate options - edit and recompile to change
+const (
+	// Generate a throwaway self-signed certificate when the cert files are
+	// missing. Browsers will warn; for local testing only.
+	selfSignedFallback = false
+
+	acmeCacheDir = "certs" // Where Let's Encrypt certificates and account keys are kept
+)
+
+// Domains to obtain Let's Encrypt certificates for, e.g. {"ch.at", "www.ch.at"}.
+// When set, cert.pem and key.pem are ignored and certificates renew automatically.
+// The HTTP listener on port 80 answers the ACME challenges.
+var acmeDomains = []string{}
+
+var acmeManager = sync.OnceValue(func() *autocert.Manager {
+	return newACMEManager(acmeDomains, acmeCacheDir)
+})
+
+// newACMEManager obtains certificates for domains, keeping them in cacheDir.
+// It returns nil if there are no domains.
+func newACMEManager(domains []string, cacheDir string) *autocert.Manager {
+	if len(domains) == 0 {
+		return nil
+	}
+	return &autocert.Manager{
+		Prompt:     autocert.AcceptTOS,
+		HostPolicy: autocert.HostWhitelist(domains...),
+		Cache:      autocert.DirCache(cacheDir),
+	}
+}
+
+// acmeHTTPHandler answers ACME HTTP-01 challenges and passes everything else to h
+func acmeHTTPHandler(h http.Handler) http.Handler {
+	if m := acmeManager(); m != nil {
+		return m.HTTPHandler(h)
+	}
+	return h
+}
+
+// tlsConfig returns the TLS settings for the HTTPS listener, or nil to load
+// certFile and keyFile as usual.
+func tlsConfig(certFile, keyFile string) (*tls.Config, error) {
+	if m := acmeManager(); m != nil {
+		return m.TLSConfig(), nil
+	}
+	if !selfSignedFallback || (fileExists(certFile) && fileExists(keyFile)) {
+		return nil, nil
+	}
+	log.Printf("WARNING: %s or %s not found, serving HTTPS with a self-signed certificate - do not use in production", certFile, keyFile)
+	cert, err := selfSignedCert()
+	if err != nil {
+		return nil, err
+	}
+	return &tls.Config{Certificates: []tls.Certificate{cert}}, nil
+}
+
+func fileExists(path string) bool {
+	_, err := os.Stat(path)
+	return !errors.Is(err, os.ErrNotExist)
+}
+
+// selfSignedCert creates an in-memory certificate for localhost, valid for a year
+func selfSignedCert() (tls.Certificate, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+
+	template := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: "ch.at self-signed"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(365 * 24 * time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		DNSNames:              []string{"localhost"},
+		IPAddresses:           []net.IP{net.IPv4(127, 0, 0, 1), net.IPv6loopback},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, nil
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+func TestSelfSignedCert(t *testing.T) {
+	cert, err := selfSignedCert()
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, host := range []string{"localhost", "127.0.0.1", "::1"} {
+		if err := leaf.VerifyHostname(host); err != nil {
+			t.Errorf("not valid for %s: %v", host, err)
+		}
+	}
+	if now := time.Now(); now.Before(leaf.NotBefore) || now.After(leaf.NotAfter) || leaf.NotAfter.Before(now.Add(300*24*time.Hour)) {
+		t.Errorf("valid from %s to %s, want from now for about a year", leaf.NotBefore, leaf.NotAfter)
+	}
+
+	// A client trusting it can talk to a server using it
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	srv.TLS = &tls.Config{Certificates: []tls.Certificate{cert}}
+	srv.StartTLS()
+	defer srv.Close()
+	pool := x509.NewCertPool()
+	pool.AddCert(leaf)
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool}}}
+	resp, err := client.Get(srv.URL)
+	if err != nil {
+		t.Fatalf("handshake with the self-signed certificate: %v", err)
+	}
+	resp.Body.Close()
+}
+
+func TestSelfSignedCertsDiffer(t *testing.T) {
+	a, errA := selfSignedCert()
+	b, errB := selfSignedCert()
+	if errA != nil || errB != nil {
+		t.Fatal(errA, errB)
+	}
+	leafA, _ := x509.ParseCertificate(a.Certificate[0])
+	leafB, _ := x509.ParseCertificate(b.Certificate[0])
+	if leafA.SerialNumber.Cmp(leafB.SerialNumber) == 0 {
+		t.Error("two certificates share a serial number")
+	}
+}
+
+func TestFileExists(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "cert.pem")
+	if fileExists(path) {
+		t.Errorf("%s exists before it is written", path)
+	}
+	if err := os.WriteFile(path, nil, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if !fileExists(path) {
+		t.Errorf("%s missing after it is written", path)
+	}
+}
+
+func TestNewACMEManager(t *testing.T) {
+	if m := newACMEManager(nil, t.TempDir()); m != nil {
+		t.Error("manager without domains")
+	}
+
+	dir := t.TempDir()
+	m := newACMEManager([]string{"ch.at", "www.ch.at"}, dir)
+	if m == nil {
+		t.Fatal("no manager for configured domains")
+	}
+	for host, ok := range map[string]bool{"ch.at": true, "www.ch.at": true, "evil.example": false} {
+		if err := m.HostPolicy(context.Background(), host); (err == nil) != ok {
+			t.Errorf("HostPolicy(%s) = %v", host, err)
+		}
+	}
+	if cache, ok := m.Cache.(autocert.DirCache); !ok || string(cache) != dir {
+		t.Errorf("cache %#v, want the directory %s", m.Cache, dir)
+	}
+	if !slices.Contains(m.TLSConfig().NextProtos, acme.ALPNProto) {
+		t.Errorf("TLS config offers %v, want the ACME challenge protocol", m.TLSConfig().NextProtos)
+	}
+}
+
+func TestACMEHandlerPassesOtherRequests(t *testing.T) {
+	m := newACMEManager([]string{"ch.at"}, t.TempDir())
+	var reached []string
+	h := m.HTTPHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		reached = append(reached, r.URL.Path)
+	}))
+
+	for _, path := range []string{"/?q=hi", "/v1/chat/completions", "/.well-known/acme-challenge/unknown-token"} {
+		r := httptest.NewRequest("GET", path, nil)
+		r.Host = "ch.at"
+		h.ServeHTTP(httptest.NewRecorder(), r)
+	}
+	if want := []string{"/", "/v1/chat/completions"}; !slices.Equal(reached, want) {
+		t.Errorf("handler reached for %v, want %v", reached, want)
+	}
+}
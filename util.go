@@ -1,14 +1,80 @@
 package main
 
 import (
+	"context"
+	"crypto/rand"
+	"errors"
 	"net"
+	"runtime/debug"
+	"slices"
+	"strconv"
 	"sync"
 	"sync/atomic"
+	"time"
 
 	"golang.org/x/time/rate"
 )
 
-const maxEntries = 10000 // Rotate when current map reaches this size (~2.5MB)
+const (
+	maxEntries       = 10000            // Rotate when current map reaches this size (~2.5MB)
+	maxConcurrentLLM = 50               // Simultaneous upstream LLM calls across all protocols
+	llmQueueTimeout  = 10 * time.Second // Longest wait for a free slot before giving up
+	maxPerIP         = 8                // Simultaneous LLM requests (streams included) from one IP
+	streamRate       = 0                // Bytes per second one stream may deliver (0 for unlimited)
+)
+
+var errServerBusy = errors.New("server busy, try again later")
+
+var errNotConfigured = errors.New("service not configured")
+
+// llmReady reports whether the LLM backend can take requests, returning an
+// error wrapping errNotConfigured if not. The backend in llm.go may replace
+// it; by default the backend is assumed ready.
+var llmReady = func() error { return nil }
+
+// llmEmbed returns one embedding vector per input, computed with model (""
+// for the backend's default), and the number of input tokens used. It is nil
+// unless the backend in llm.go supports embeddings.
+var llmEmbed func(ctx context.Context, model string, input []string) ([][]float64, int, error)
+
+// llmEmbeddingModel is the backend's default embedding model, which requests
+// to /v1/embeddings may also name explicitly. llm.go sets it with llmEmbed.
+var llmEmbeddingModel string
+
+// llmCall is the backend's LLM, which callLLM calls. Tests replace it with a
+// stand-in backend.
+var llmCall = LLM
+
+var llmSlots = make(chan struct{}, maxConcurrentLLM)
+
+// acquireLLMSlot waits for a free upstream slot. It gives up when ctx is done
+// (so the DNS deadline still fires while queued) or after llmQueueTimeout.
+func acquireLLMSlot(ctx context.Context) (release func(), err error) {
+	timer := time.NewTimer(llmQueueTimeout)
+	defer timer.Stop()
+
+	select {
+	case llmSlots <- struct{}{}:
+		return func() { <-llmSlots }, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-timer.C:
+		return nil, errServerBusy
+	}
+}
+
+// callLLM calls LLM once it holds an upstream slot, with the same contract
+func callLLM(ctx context.Context, input interface{}, stream chan<- string) (string, error) {
+	release, err := acquireLLMSlot(ctx)
+	if err != nil {
+		if stream != nil {
+			close(stream)
+		}
+		return "", err
+	}
+	defer release()
+	return llmCall(ctx, input, stream)
+}
 
 var (
 	current      = &sync.Map{}
@@ -16,34 +82,262 @@ var (
 	currentCount int64
 )
 
-func rateLimitAllow(addr string) bool {
-	ip := addr
+// listenAddr joins a bind address ("" for all interfaces) and a port,
+// bracketing IPv6 addresses
+func listenAddr(bind string, port int) string {
+	return net.JoinHostPort(bind, strconv.Itoa(port))
+}
+
+// clientIP strips the port from a remote address
+func clientIP(addr string) string {
 	if host, _, err := net.SplitHostPort(addr); err == nil {
-		ip = host
+		return host
+	}
+	return addr
+}
+
+func rateLimitAllow(addr string) bool {
+	return allowKey(clientIP(addr), 100.0/60, 10)
+}
+
+// Stricter limits for expensive models, per client IP and on top of the
+// general one. Models not listed have none; "" is the backend's default.
+var modelRates = map[string]modelRate{
+	// "gpt-4o": {perMinute: 10, burst: 3},
+}
+
+type modelRate struct {
+	perMinute float64
+	burst     int
+}
+
+// modelRateAllow applies the limit configured for model, if any, to addr
+func modelRateAllow(addr, model string) bool {
+	r, ok := modelRates[model]
+	if !ok {
+		return true
 	}
+	return allowKey(clientIP(addr)+" "+model, rate.Limit(r.perMinute/60), r.burst)
+}
 
+// allowKey takes a token from key's limiter, creating it with limit and burst
+func allowKey(key string, limit rate.Limit, burst int) bool {
 	if atomic.LoadInt64(&currentCount) >= maxEntries {
 		rotate()
 	}
 
-	if val, ok := current.Load(ip); ok {
+	if val, ok := current.Load(key); ok {
 		return val.(*rate.Limiter).Allow()
 	}
 
-	if val, ok := previous.Load(ip); ok {
-		current.Store(ip, val)
+	if val, ok := previous.Load(key); ok {
+		current.Store(key, val)
 		atomic.AddInt64(&currentCount, 1)
 		return val.(*rate.Limiter).Allow()
 	}
 
-	limiter := rate.NewLimiter(100.0/60, 10)
-	current.Store(ip, limiter)
+	limiter := rate.NewLimiter(limit, burst)
+	current.Store(key, limiter)
 	atomic.AddInt64(&currentCount, 1)
 	return limiter.Allow()
 }
 
+var (
+	activeMu   sync.Mutex
+	activeByIP = make(map[string]int)
+)
+
+// acquireIPSlot counts a request against its IP's concurrency cap. Unlike the
+// rate limit this bounds how many long-running streams one client can hold
+// open. ok is false when the IP already has maxPerIP requests in flight.
+func acquireIPSlot(addr string) (release func(), ok bool) {
+	ip := clientIP(addr)
+	activeMu.Lock()
+	defer activeMu.Unlock()
+	if activeByIP[ip] >= maxPerIP {
+		return nil, false
+	}
+	activeByIP[ip]++
+	return func() {
+		activeMu.Lock()
+		defer activeMu.Unlock()
+		if activeByIP[ip]--; activeByIP[ip] <= 0 {
+			delete(activeByIP, ip)
+		}
+	}, true
+}
+
 func rotate() {
 	previous = current
 	current = &sync.Map{}
 	atomic.StoreInt64(&currentCount, 0)
 }
+
+const base62 = "0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
+
+// newRequestID returns 24 random base62 characters
+func newRequestID() string {
+	b := make([]byte, 24)
+	rand.Read(b)
+	for i := range b {
+		b[i] = base62[int(b[i])%len(base62)]
+	}
+	return string(b)
+}
+
+type requestIDKey struct{}
+
+// withRequestID attaches a correlation id to ctx; the LLM backend forwards it upstream
+func withRequestID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, requestIDKey{}, id)
+}
+
+// requestID returns the id attached by withRequestID, or ""
+func requestID(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+type backendKey struct{}
+
+// backendRecord is where the LLM backend notes which upstream answered
+type backendRecord struct {
+	mu   sync.Mutex
+	name string
+}
+
+// withBackendRecord lets the caller learn which upstream answers calls made with ctx
+func withBackendRecord(ctx context.Context) (context.Context, *backendRecord) {
+	rec := &backendRecord{}
+	return context.WithValue(ctx, backendKey{}, rec), rec
+}
+
+// recordBackend notes that the upstream called name answered, if the caller asked
+func recordBackend(ctx context.Context, name string) {
+	if rec, ok := ctx.Value(backendKey{}).(*backendRecord); ok {
+		rec.mu.Lock()
+		rec.name = name
+		rec.mu.Unlock()
+	}
+}
+
+// Name returns the upstream recorded last, or ""
+func (rec *backendRecord) Name() string {
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	return rec.name
+}
+
+// Model each protocol asks for when the request names none, e.g. a fast,
+// cheap one for DNS. "" keeps the backend's default.
+var protocolModels = map[string]string{
+	"http": "", // Web and curl requests to /
+	"api":  "", // /v1/chat/completions
+	"dns":  "",
+}
+
+// Models a JSON request to / or /v1/embeddings may name, besides those in
+// modelRates and protocolModels (and the default embedding model). Any other
+// name is refused, so clients can't spend the upstream key on models the
+// operator didn't choose.
+var allowedModels = []string{
+	// "gpt-4o-mini",
+}
+
+// modelAllowed reports whether a request may ask for model by name
+func modelAllowed(model string) bool {
+	if _, ok := modelRates[model]; ok {
+		return true
+	}
+	for _, m := range protocolModels {
+		if m != "" && m == model {
+			return true
+		}
+	}
+	return slices.Contains(allowedModels, model)
+}
+
+// embeddingModelAllowed reports whether a /v1/embeddings request may ask for
+// model by name; "" means the backend's default embedding model
+func embeddingModelAllowed(model string) bool {
+	return model == "" || model == llmEmbeddingModel || modelAllowed(model)
+}
+
+type modelKey struct{}
+
+// withModel asks the LLM backend to answer with model instead of its default
+func withModel(ctx context.Context, model string) context.Context {
+	return context.WithValue(ctx, modelKey{}, model)
+}
+
+// withProtocolModel applies the model configured for protocol, if any
+func withProtocolModel(ctx context.Context, protocol string) context.Context {
+	if model := protocolModels[protocol]; model != "" {
+		return withModel(ctx, model)
+	}
+	return ctx
+}
+
+// requestedModel returns the model set by withModel, or ""
+func requestedModel(ctx context.Context) string {
+	model, _ := ctx.Value(modelKey{}).(string)
+	return model
+}
+
+// streamThrottle paces one stream to streamRate bytes per second. Reading
+// the upstream more slowly also slows how fast it is consumed.
+type streamThrottle struct {
+	limiter *rate.Limiter
+}
+
+func newStreamThrottle() streamThrottle {
+	if streamRate <= 0 {
+		return streamThrottle{}
+	}
+	return streamThrottle{rate.NewLimiter(rate.Limit(streamRate), streamRate)}
+}
+
+// wait blocks until n more bytes may be sent, or ctx is done
+func (t streamThrottle) wait(ctx context.Context, n int) error {
+	if t.limiter == nil {
+		return nil
+	}
+	for n > 0 {
+		k := min(n, t.limiter.Burst())
+		if err := t.limiter.WaitN(ctx, k); err != nil {
+			return err
+		}
+		n -= k
+	}
+	return nil
+}
+
+// BuildInfo identifies the running binary
+type BuildInfo struct {
+	Version   string `json:"version"`
+	Commit    string `json:"commit"`
+	BuildTime string `json:"build_time"`
+}
+
+// buildInfo returns the -ldflags values, falling back to the VCS details the
+// Go toolchain embeds and then to "unknown"
+func buildInfo() BuildInfo {
+	info := BuildInfo{Version: version, Commit: commit, BuildTime: buildTime}
+	if bi, ok := debug.ReadBuildInfo(); ok {
+		for _, s := range bi.Settings {
+			switch {
+			case s.Key == "vcs.revision" && info.Commit == "":
+				info.Commit = s.Value
+			case s.Key == "vcs.time" && info.BuildTime == "":
+				info.BuildTime = s.Value
+			}
+		}
+	}
+	if info.Commit == "" {
+		info.Commit = "unknown"
+	}
+	if info.BuildTime == "" {
+		info.BuildTime = "unknown"
+	}
+	return info
+}
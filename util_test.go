@@ -0,0 +1,375 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"golang.org/x/time/rate"
+)
+
+func TestCallLLMBoundsConcurrency(t *testing.T) {
+	var inFlight, peak atomic.Int32
+	release := make(chan struct{})
+	stubLLM(t, func(ctx context.Context, input interface{}, stream chan<- string) (string, error) {
+		n := inFlight.Add(1)
+		defer inFlight.Add(-1)
+		for {
+			p := peak.Load()
+			if n <= p || peak.CompareAndSwap(p, n) {
+				break
+			}
+		}
+		<-release
+		return "ok", nil
+	})
+
+	var wg sync.WaitGroup
+	for i := 0; i < maxConcurrentLLM+10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := callLLM(context.Background(), "hi", nil); err != nil {
+				t.Errorf("callLLM: %v", err)
+			}
+		}()
+	}
+	deadline := time.Now().Add(2 * time.Second)
+	for inFlight.Load() < maxConcurrentLLM && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	// Give the queued calls a chance to overrun the cap
+	time.Sleep(20 * time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	if got := peak.Load(); got != maxConcurrentLLM {
+		t.Errorf("peak of %d concurrent calls, want %d", got, maxConcurrentLLM)
+	}
+}
+
+// fillLLMSlots takes every upstream slot until the test ends
+func fillLLMSlots(t *testing.T) {
+	for i := 0; i < cap(llmSlots); i++ {
+		llmSlots <- struct{}{}
+	}
+	t.Cleanup(func() {
+		for i := 0; i < cap(llmSlots); i++ {
+			<-llmSlots
+		}
+	})
+}
+
+func TestCallLLMQueueFollowsContext(t *testing.T) {
+	called := false
+	stubLLM(t, func(ctx context.Context, input interface{}, stream chan<- string) (string, error) {
+		called = true
+		return "ok", nil
+	})
+	fillLLMSlots(t)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	stream := make(chan string)
+	start := time.Now()
+	_, err := callLLM(ctx, "hi", stream)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("err = %v, want the context's deadline", err)
+	}
+	if elapsed := time.Since(start); elapsed > llmQueueTimeout/2 {
+		t.Errorf("waited %s in the queue, past the context's deadline", elapsed)
+	}
+	if _, open := <-stream; open {
+		t.Error("stream left open after giving up")
+	}
+	if called {
+		t.Error("backend called without a slot")
+	}
+}
+
+func TestCallLLMReleasesSlot(t *testing.T) {
+	stubLLM(t, failWith(errors.New("upstream down")))
+	for i := 0; i < maxConcurrentLLM+1; i++ {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		_, err := callLLM(ctx, "hi", nil)
+		cancel()
+		if err == nil || err.Error() != "upstream down" {
+			t.Fatalf("call %d: err = %v, want the backend's error", i, err)
+		}
+	}
+	if n := len(llmSlots); n != 0 {
+		t.Errorf("%d slots still held after every call returned", n)
+	}
+}
+
+func TestAskLLMStopsWhenCancelled(t *testing.T) {
+	useCache(t, 0)
+	old := redactRules
+	t.Cleanup(func() { redactRules = old })
+
+	for _, tt := range []struct {
+		name  string
+		rules []*regexp.Regexp
+	}{
+		{"plain", nil},
+		{"redacting", []*regexp.Regexp{regexp.MustCompile(`secret`)}},
+	} {
+		redactRules = tt.rules
+		stopped := make(chan struct{})
+		stubLLM(t, func(ctx context.Context, input interface{}, stream chan<- string) (string, error) {
+			defer close(stopped)
+			return endlessReply(time.Minute, "chunk ")(ctx, input, stream)
+		})
+
+		ctx, cancel := context.WithCancel(context.Background())
+		ch := make(chan string)
+		errc := make(chan error, 1)
+		go func() {
+			_, err := askLLM(ctx, "endless "+tt.name, ch)
+			errc <- err
+		}()
+		<-ch
+		cancel()
+
+		select {
+		case <-stopped:
+		case <-time.After(time.Second):
+			t.Fatalf("%s: backend still streaming after cancel", tt.name)
+		}
+		for range ch {
+		}
+		if err := <-errc; !errors.Is(err, context.Canceled) {
+			t.Errorf("%s: err = %v, want context.Canceled", tt.name, err)
+		}
+	}
+}
+
+func TestAcquireIPSlot(t *testing.T) {
+	ip := clientIP(testAddr())
+	var releases []func()
+	for i := 0; i < maxPerIP; i++ {
+		// Each connection has its own port; the cap is per IP
+		release, ok := acquireIPSlot(net.JoinHostPort(ip, strconv.Itoa(1000+i)))
+		if !ok {
+			t.Fatalf("slot %d refused", i)
+		}
+		releases = append(releases, release)
+	}
+	if _, ok := acquireIPSlot(net.JoinHostPort(ip, "2000")); ok {
+		t.Error("slot granted past maxPerIP")
+	}
+	other, ok := acquireIPSlot(testAddr())
+	if !ok {
+		t.Error("another IP refused")
+	} else {
+		other()
+	}
+
+	releases[0]()
+	release, ok := acquireIPSlot(net.JoinHostPort(ip, "2000"))
+	if !ok {
+		t.Fatal("slot still refused after one was released")
+	}
+	releases[0] = release
+	for _, release := range releases {
+		release()
+	}
+	activeMu.Lock()
+	_, tracked := activeByIP[ip]
+	activeMu.Unlock()
+	if tracked {
+		t.Error("IP still tracked with no requests in flight")
+	}
+}
+
+func TestRootConcurrentStreamsPerIP(t *testing.T) {
+	release := make(chan struct{})
+	started := make(chan struct{}, maxPerIP)
+	stubLLM(t, func(ctx context.Context, input interface{}, stream chan<- string) (string, error) {
+		started <- struct{}{}
+		select {
+		case <-release:
+		case <-ctx.Done():
+		}
+		return replyWith("done")(ctx, input, stream)
+	})
+
+	addr := testAddr()
+	request := func() *http.Request {
+		r := httptest.NewRequest("GET", "/?q=hi", nil)
+		r.RemoteAddr = addr
+		r.Header.Set("Accept", "text/event-stream")
+		return r
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < maxPerIP; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			serve(handleRoot, request())
+		}()
+	}
+	for i := 0; i < maxPerIP; i++ {
+		<-started
+	}
+
+	if w := serve(handleRoot, request()); w.Code != http.StatusTooManyRequests {
+		t.Errorf("stream %d from one IP: status %d, want 429", maxPerIP+1, w.Code)
+	}
+	close(release)
+	wg.Wait()
+
+	// Finished streams give their slots back
+	stubLLM(t, replyWith("ok"))
+	if w := serve(handleRoot, request()); w.Code != http.StatusOK {
+		t.Errorf("after the streams ended: status %d", w.Code)
+	}
+}
+
+func TestModelRates(t *testing.T) {
+	old := modelRates
+	modelRates = map[string]modelRate{
+		"expensive": {perMinute: 1, burst: 2},
+		"cheap":     {perMinute: 6000, burst: 100},
+	}
+	t.Cleanup(func() { modelRates = old })
+	stubLLM(t, replyWith("ok"))
+
+	ask := func(addr, model string) int {
+		r := httptest.NewRequest("POST", "/", strings.NewReader(`{"q":"hi","model":"`+model+`"}`))
+		r.Header.Set("Content-Type", "application/json")
+		r.RemoteAddr = addr
+		return serve(handleRoot, r).Code
+	}
+
+	// One client, well within the general limit's burst
+	addr := testAddr()
+	for i := 0; i < 2; i++ {
+		if code := ask(addr, "expensive"); code != http.StatusOK {
+			t.Fatalf("expensive request %d: status %d", i, code)
+		}
+	}
+	if code := ask(addr, "expensive"); code != http.StatusTooManyRequests {
+		t.Errorf("expensive request past its burst: status %d, want 429", code)
+	}
+	for i := 0; i < 5; i++ {
+		if code := ask(addr, "cheap"); code != http.StatusOK {
+			t.Errorf("cheap request %d after the expensive limit: status %d", i, code)
+		}
+	}
+	if code := ask(testAddr(), "expensive"); code != http.StatusOK {
+		t.Errorf("expensive request from another client: status %d", code)
+	}
+
+	// Models without a configured rate only have the general limit
+	for i := 0; i < 20; i++ {
+		if !modelRateAllow(addr, "unlisted") {
+			t.Fatalf("unlisted model refused after %d requests", i)
+		}
+	}
+}
+
+func TestListenAddr(t *testing.T) {
+	for _, tt := range []struct {
+		bind string
+		port int
+		want string
+	}{
+		{"", 80, ":80"},
+		{"127.0.0.1", 53, "127.0.0.1:53"},
+		{"::1", 2222, "[::1]:2222"},
+		{"::", 443, "[::]:443"},
+		{"localhost", 8080, "localhost:8080"},
+	} {
+		if got := listenAddr(tt.bind, tt.port); got != tt.want {
+			t.Errorf("listenAddr(%q, %d) = %q, want %q", tt.bind, tt.port, got, tt.want)
+		}
+	}
+}
+
+func TestStreamThrottlePaces(t *testing.T) {
+	// 1000 bytes a second, with a 100-byte burst
+	throttle := streamThrottle{rate.NewLimiter(1000, 100)}
+	start := time.Now()
+	// The first 100 bytes go out at once, the next 200 (in chunks larger
+	// than the burst) take about 200ms
+	for _, n := range []int{100, 150, 50} {
+		if err := throttle.wait(context.Background(), n); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if elapsed := time.Since(start); elapsed < 150*time.Millisecond || elapsed > time.Second {
+		t.Errorf("300 bytes took %s, want about 200ms", elapsed)
+	}
+}
+
+func TestStreamThrottleStopsWithContext(t *testing.T) {
+	throttle := streamThrottle{rate.NewLimiter(10, 10)}
+	throttle.wait(context.Background(), 10)
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if err := throttle.wait(ctx, 1000); err == nil {
+		t.Error("waited out 100s of throttling past the context's deadline")
+	}
+}
+
+func TestStreamThrottleOff(t *testing.T) {
+	var throttle streamThrottle
+	start := time.Now()
+	if err := throttle.wait(context.Background(), 1<<30); err != nil || time.Since(start) > 10*time.Millisecond {
+		t.Errorf("unthrottled wait = %v after %s", err, time.Since(start))
+	}
+	if streamRate <= 0 && newStreamThrottle().limiter != nil {
+		t.Error("throttle on although streamRate is off")
+	}
+}
+
+func TestProtocolModels(t *testing.T) {
+	useCache(t, 0)
+	old := protocolModels
+	protocolModels = map[string]string{"http": "web-model", "api": "api-model", "dns": "dns-model"}
+	t.Cleanup(func() { protocolModels = old })
+	models := make(chan string, 1)
+	stubLLM(t, func(ctx context.Context, input interface{}, stream chan<- string) (string, error) {
+		models <- requestedModel(ctx)
+		return replyWith("ok")(ctx, input, stream)
+	})
+
+	serve(handleRoot, newTestRequest("GET", "/?q=hi", nil))
+	if got := <-models; got != "web-model" {
+		t.Errorf("/ asked for %q, want web-model", got)
+	}
+	serve(handleChatCompletions, newTestRequest("POST", "/v1/chat/completions", strings.NewReader(`{"messages":[{"role":"user","content":"hi"}]}`)))
+	if got := <-models; got != "api-model" {
+		t.Errorf("/v1 asked for %q, want api-model", got)
+	}
+	askDNS(t, "udp", dnsQuery("hi.ch.at", dns.TypeTXT, 0))
+	if got := <-models; got != "dns-model" {
+		t.Errorf("DNS asked for %q, want dns-model", got)
+	}
+
+	// A model named in the request wins
+	r := newTestRequest("POST", "/", strings.NewReader(`{"q":"hi","model":"dns-model"}`))
+	r.Header.Set("Content-Type", "application/json")
+	serve(handleRoot, r)
+	if got := <-models; got != "dns-model" {
+		t.Errorf("/ with a model named asked for %q", got)
+	}
+
+	// Left empty, the backend's default is used
+	protocolModels = map[string]string{}
+	serve(handleRoot, newTestRequest("GET", "/?q=hi", nil))
+	if got := <-models; got != "" {
+		t.Errorf("unconfigured / asked for %q", got)
+	}
+}